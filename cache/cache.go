@@ -1,67 +1,209 @@
 package cache
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"path"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/MJKWoolnough/downloader"
 )
 
 type Cache struct {
 	objects map[string]*object
+	stored  map[string]Stats
 	mutex   sync.Mutex
 	dir     string
+	limit   int64
+	policy  Policy
+	opts    options
 }
 
-func NewCache(dir string) *Cache {
-	return &Cache{
+// options contains the Cache settings that are passed to each object when it
+// is opened.
+type options struct {
+	retry        RetryPolicy
+	maxDownloads int
+	slots        *downloadSlots
+	readAhead    int64
+	chunkSize    int64
+	adaptive     time.Duration
+}
+
+// NewCache creates a cache in the given directory, reloading the index of
+// any objects previously stored there.
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{
 		objects: make(map[string]*object),
+		stored:  make(map[string]Stats),
 		dir:     dir,
+		policy:  LRU,
+		opts: options{
+			retry:     DefaultRetryPolicy,
+			slots:     newDownloadSlots(),
+			readAhead: DefaultReadAhead,
+			chunkSize: DefaultChunkSize,
+		},
 	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, indexExt) {
+			continue
+		}
+		base := path.Join(dir, strings.TrimSuffix(name, indexExt))
+		i, err := readIndex(base + indexExt)
+		if err != nil {
+			removeFiles(base)
+			continue
+		}
+		i.Close()
+		if keyFilename(i.key)+indexExt != name {
+			removeFiles(base)
+			continue
+		}
+		if _, err := os.Stat(base + dataExt); err != nil {
+			removeFiles(base)
+			continue
+		}
+		c.stored[i.key] = Stats{
+			Key:        i.key,
+			Size:       i.size,
+			LastAccess: i.lastAccess,
+			Accesses:   i.accesses,
+		}
+	}
+	return c, nil
+}
+
+func removeFiles(base string) {
+	os.Remove(base + dataExt)
+	os.Remove(base + indexExt)
+}
+
+// Get retrieves the object for the given media from the cache, creating it,
+// or resuming it from disk, when it isn't currently open.
+//
+// An object continues to download in the background after its last
+// CachedObject is closed, only stopping when it is evicted, removed, or the
+// Cache is closed. Closing a CachedObject only cancels its read-ahead.
+func (c *Cache) Get(m downloader.Media) (*CachedObject, error) {
+	return c.GetContext(context.Background(), m)
 }
 
-func (c *Cache) Get(key string, r downloader.Downloader) (*CachedObject, error) {
+// GetContext acts like Get, but binds the reads of the returned CachedObject
+// to the given context.
+func (c *Cache) GetContext(ctx context.Context, m downloader.Media) (*CachedObject, error) {
+	if len(m.Sources) == 0 {
+		return nil, NoSources{}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	var err error
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	o, ok := c.objects[key]
+	o, ok := c.objects[m.UID]
+	if ok {
+		ok = !c.dropStale(m.UID, o)
+	}
 	if !ok {
-		o, err = newObject(path.Join(c.dir, key), r)
+		o, err = newObject(path.Join(c.dir, keyFilename(m.UID)), m, c.opts)
 		if err != nil {
 			return nil, err
 		}
-		c.objects[key] = o
+		o.accesses = c.stored[m.UID].Accesses
+		delete(c.stored, m.UID)
+		c.objects[m.UID] = o
 	}
+	id := o.open()
+	c.evict()
 	return &CachedObject{
-		o: o,
+		o:   o,
+		id:  id,
+		ctx: ctx,
+		release: func() {
+			o.release()
+			c.mutex.Lock()
+			c.evict()
+			c.mutex.Unlock()
+		},
 	}, nil
 }
 
+// dropStale stops the object if its data has changed and it has no readers,
+// so that it is downloaded anew when next opened. The mutex must be held when
+// calling.
+func (c *Cache) dropStale(key string, o *object) bool {
+	s, ok := o.staleStats()
+	if !ok {
+		return false
+	}
+	close(o.quit)
+	delete(c.objects, key)
+	s.Key = key
+	c.stored[key] = s
+	return true
+}
+
+// Remove removes the object from the cache, deleting its files from disk.
 func (c *Cache) Remove(key string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	c.remove(key)
+}
+
+func (c *Cache) remove(key string) {
 	if o, ok := c.objects[key]; ok {
 		close(o.quit)
 		delete(c.objects, key)
 	}
+	delete(c.stored, key)
+	removeFiles(path.Join(c.dir, keyFilename(key)))
 }
 
 func (c *Cache) Keys() []string {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	os := make([]string, 0, len(c.objects))
+	os := make([]string, 0, len(c.objects)+len(c.stored))
 	for key := range c.objects {
 		os = append(os, key)
 	}
+	for key := range c.stored {
+		os = append(os, key)
+	}
 	return os
 }
 
+// Close stops all open objects. Their data remains on disk and will be
+// reloaded by the next call to NewCache for the same directory.
 func (c *Cache) Close() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	for key, o := range c.objects {
 		close(o.quit)
 		delete(c.objects, key)
+		s := o.stats()
+		s.Key = key
+		c.stored[key] = s
 	}
 	return nil
 }
+
+// Errors
+
+// NoSources is an error returned when a Media with no sources is requested.
+type NoSources struct{}
+
+func (NoSources) Error() string {
+	return "media has no sources"
+}
@@ -0,0 +1,1201 @@
+package cache
+
+import (
+	"context"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+type memDownloader struct {
+	data string
+	sync.Mutex
+	requests int
+}
+
+func (m *memDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	m.Lock()
+	m.requests++
+	m.Unlock()
+	if length < 0 || start+length > int64(len(m.data)) {
+		length = int64(len(m.data)) - start
+	}
+	return ioutil.NopCloser(strings.NewReader(m.data[start : start+length])), nil
+}
+
+func (m *memDownloader) Length() int64 {
+	return int64(len(m.data))
+}
+
+func (m *memDownloader) Requests() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.requests
+}
+
+func testData(size int) string {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte('a' + i%26)
+	}
+	return string(b)
+}
+
+func testMedia(uid string, d downloader.Downloader) downloader.Media {
+	return downloader.Media{
+		Size:         d.Length(),
+		MimeType:     "video/mp4",
+		UID:          uid,
+		LastModified: time.Unix(1234567890, 0),
+		Sources:      []downloader.Downloader{d},
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := testMedia("index/test", &memDownloader{data: testData(3*DefaultChunkSize + 5)})
+	filename := dir + "/" + keyFilename(m.UID) + indexExt
+	i, err := createIndex(filename, m.UID, m, m.Size, DefaultChunkSize)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err = i.setDone(1, 0x12345678); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err = i.setDone(3, 0x9abcdef0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	i.Close()
+
+	if i, err = readIndex(filename); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer i.Close()
+	if i.key != m.UID {
+		t.Errorf("expecting key %q, got %q", m.UID, i.key)
+	}
+	if !i.matches(m, m.Size) {
+		t.Errorf("expecting index to match media")
+	}
+	for n, done := range [...]bool{false, true, false, true} {
+		if i.done(uint(n)) != done {
+			t.Errorf("chunk %d: expecting done %v, got %v", n, done, !done)
+		}
+	}
+	if sum := i.sum(3); sum != 0x9abcdef0 {
+		t.Errorf("expecting checksum %x, got %x", 0x9abcdef0, sum)
+	}
+	m.MimeType = "video/webm"
+	if i.matches(m, m.Size) {
+		t.Errorf("expecting index not to match changed media")
+	}
+}
+
+func TestCacheResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := testData(5*DefaultChunkSize + 123)
+	d := &memDownloader{data: data}
+	m := testMedia("test-object", d)
+	start := time.Now()
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o, err := c.Get(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("cached data does not match source")
+	}
+	c.Close()
+
+	if c, err = NewCache(dir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	if keys := c.Keys(); len(keys) != 1 || keys[0] != m.UID {
+		t.Fatalf("expecting keys [%s], got %v", m.UID, keys)
+	}
+	if s := c.stored[m.UID]; s.Accesses != 1 || !s.LastAccess.After(start) {
+		t.Errorf("expecting reloaded stats to record 1 access after %s, got %d at %s", start, s.Accesses, s.LastAccess)
+	}
+	d2 := &memDownloader{data: data}
+	if o, err = c.Get(testMedia(m.UID, d2)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("reloaded data does not match source")
+	}
+	if r := d2.Requests(); r != 0 {
+		t.Errorf("expecting no requests to source after reload, got %d", r)
+	}
+
+	c.Remove(m.UID)
+	if keys := c.Keys(); len(keys) != 0 {
+		t.Errorf("expecting no keys after removal, got %v", keys)
+	}
+}
+
+func TestCacheLongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := testData(DefaultChunkSize + 10)
+	m := testMedia("http-"+strings.Repeat("/long/path", 100), &memDownloader{data: data})
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o, err := c.Get(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("cached data does not match source")
+	}
+	c.Close()
+
+	if c, err = NewCache(dir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	if keys := c.Keys(); len(keys) != 1 || keys[0] != m.UID {
+		t.Errorf("expecting keys [%s], got %v", m.UID, keys)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	c.SetLimit(3*DefaultChunkSize, LRU)
+
+	objects := make([]*CachedObject, 0, 3)
+	for _, key := range [...]string{"a", "b", "c"} {
+		o, err := c.Get(testMedia(key, &memDownloader{data: testData(DefaultChunkSize)}))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		objects = append(objects, o)
+	}
+	objects[1].Close()
+	objects[0].Close()
+
+	o, err := c.Get(testMedia("d", &memDownloader{data: testData(DefaultChunkSize)}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+	keys := make(map[string]bool)
+	for _, key := range c.Keys() {
+		keys[key] = true
+	}
+	if len(keys) != 3 || keys["b"] || !keys["a"] || !keys["c"] || !keys["d"] {
+		t.Errorf("expecting b to be evicted, got keys %v", c.Keys())
+	}
+
+	c.SetLimit(DefaultChunkSize, LRU)
+	if keys := c.Keys(); len(keys) != 2 {
+		t.Errorf("expecting only open objects to remain, got keys %v", keys)
+	}
+	if u := c.Usage(); u != 2*DefaultChunkSize {
+		t.Errorf("expecting usage %d, got %d", 2*DefaultChunkSize, u)
+	}
+	objects[2].Close()
+	if keys := c.Keys(); len(keys) != 1 || keys[0] != "d" {
+		t.Errorf("expecting keys [d], got %v", keys)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	now := time.Now()
+	a := Stats{Key: "a", Size: 100, LastAccess: now.Add(-time.Hour), Accesses: 5}
+	b := Stats{Key: "b", Size: 1000, LastAccess: now, Accesses: 1}
+	tests := []struct {
+		Policy
+		first string
+	}{
+		{LRU, "a"},
+		{LFU, "b"},
+		{SizeWeighted, "b"},
+	}
+
+	for n, test := range tests {
+		first := "b"
+		if test.Less(a, b) {
+			first = "a"
+		}
+		if first != test.first {
+			t.Errorf("test %d: expecting %s to be evicted first, got %s", n+1, test.first, first)
+		}
+	}
+}
+
+type blockingDownloader struct {
+	length int64
+	closed chan struct{}
+}
+
+func (b *blockingDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	return b, nil
+}
+
+func (b *blockingDownloader) Read(p []byte) (int, error) {
+	<-b.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (b *blockingDownloader) Close() error {
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
+
+func (b *blockingDownloader) Length() int64 {
+	return b.length
+}
+
+func TestCacheContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	d := &blockingDownloader{length: 2 * DefaultChunkSize, closed: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	o, err := c.GetContext(ctx, testMedia("blocking", d))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err = o.Read(make([]byte, 10)); err != context.Canceled {
+		t.Errorf("expecting error %s, got %s", context.Canceled, err)
+	}
+	o.Close()
+	select {
+	case <-d.closed:
+		t.Errorf("expecting upstream download to continue after the last reader is closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Close()
+	select {
+	case <-d.closed:
+	case <-time.After(time.Second):
+		t.Errorf("expecting upstream download to be stopped")
+	}
+}
+
+type failingDownloader struct {
+	memDownloader
+	failures int
+}
+
+func (f *failingDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	f.Lock()
+	if f.failures != 0 {
+		f.failures--
+		f.requests++
+		f.Unlock()
+		return nil, io.ErrClosedPipe
+	}
+	f.Unlock()
+	return f.memDownloader.NewReadCloser(start, length)
+}
+
+func TestCacheRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	c.SetRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		MinDelay:    time.Millisecond,
+		MaxDelay:    5 * time.Millisecond,
+	})
+
+	data := testData(DefaultChunkSize)
+	tests := []struct {
+		failures int
+		err      bool
+	}{
+		{0, false},
+		{2, false},
+		{3, true},
+		{-1, true},
+	}
+
+	for n, test := range tests {
+		d := &failingDownloader{memDownloader: memDownloader{data: data}, failures: test.failures}
+		o, err := c.Get(testMedia("retry-"+strconv.Itoa(n), d))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+		got, err := ioutil.ReadAll(o)
+		o.Close()
+		if test.err {
+			if _, ok := err.(DownloadError); !ok {
+				t.Errorf("test %d: expecting DownloadError, got %v", n+1, err)
+			} else if r := d.Requests(); r != 3 {
+				t.Errorf("test %d: expecting 3 attempts, got %d", n+1, r)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(got) != data {
+			t.Errorf("test %d: cached data does not match source", n+1)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	r := RetryPolicy{MinDelay: time.Second, MaxDelay: 5 * time.Second}
+	for n, expected := range [...]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if d := r.delay(n + 1); d != expected {
+			t.Errorf("test %d: expecting delay %s, got %s", n+1, expected, d)
+		}
+	}
+	r.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := r.delay(1); d < time.Second/2 || d > time.Second {
+			t.Errorf("jittered delay %s out of range", d)
+		}
+	}
+}
+
+func TestCacheFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 10, MinDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	data := testData(4 * DefaultChunkSize)
+	dead := &failingDownloader{memDownloader: memDownloader{data: data}, failures: -1}
+	short := &memDownloader{data: data[:DefaultChunkSize]}
+	good := &memDownloader{data: data}
+	m := testMedia("failover", dead)
+	m.Sources = append(m.Sources, short, good)
+
+	o, err := c.Get(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("cached data does not match source")
+	}
+	if r := short.Requests(); r != 0 {
+		t.Errorf("expecting no requests to source with mismatched length, got %d", r)
+	}
+	if r := dead.Requests(); r > maxSourceFailures {
+		t.Errorf("expecting at most %d requests to failing source, got %d", maxSourceFailures, r)
+	}
+
+	m = testMedia("mismatch", short)
+	m.Size = int64(len(data))
+	if _, err = c.Get(m); err != (LengthMismatch{}) {
+		t.Errorf("expecting error %s, got %v", LengthMismatch{}, err)
+	}
+}
+
+func TestCacheDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	data := testData(3*DefaultChunkSize + 10)
+	sum := md5.Sum([]byte(data))
+	bad := md5.Sum(nil)
+
+	for n, test := range [...][]byte{sum[:], bad[:]} {
+		d := &memDownloader{data: data}
+		m := testMedia("digest-"+strconv.Itoa(n), d)
+		m.Digest = downloader.Digest{Algorithm: "md5", Sum: test}
+		o, err := c.Get(m)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+		cached := o.o.(*object)
+		buf := make([]byte, 10)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, err = o.ReadAt(buf, int64(len(data)-10))
+			if err != nil || cached.index.hasFlag(flagVerified) || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		o.Close()
+		if n == 0 {
+			if err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if !cached.index.hasFlag(flagVerified) {
+				t.Errorf("test %d: expecting data to be verified", n+1)
+			}
+		} else if _, ok := err.(downloader.DigestMismatch); !ok {
+			t.Errorf("test %d: expecting DigestMismatch, got %v", n+1, err)
+		} else if r := d.Requests(); r < maxDigestAttempts {
+			t.Errorf("test %d: expecting at least %d requests, got %d", n+1, maxDigestAttempts, r)
+		}
+	}
+}
+
+// corruptDownloader serves corrupted data for its first requests, with
+// readers that report a DigestMismatch once all of it has been read.
+type corruptDownloader struct {
+	memDownloader
+	corrupt int
+}
+
+func (c *corruptDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	rc, _ := c.memDownloader.NewReadCloser(start, length)
+	data, _ := ioutil.ReadAll(rc)
+	c.Lock()
+	bad := c.requests <= c.corrupt
+	c.Unlock()
+	if bad {
+		data[0] ^= 0xff
+	}
+	return &verifyingReader{Reader: strings.NewReader(string(data)), bad: bad}, nil
+}
+
+type verifyingReader struct {
+	io.Reader
+	bad bool
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.Reader.Read(p)
+	if err == io.EOF && v.bad {
+		err = downloader.DigestMismatch{}
+	}
+	return n, err
+}
+
+func (verifyingReader) Verifying() bool {
+	return true
+}
+
+func (verifyingReader) Close() error {
+	return nil
+}
+
+func TestCacheRangeDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, MinDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	data := testData(3*DefaultChunkSize + 10)
+	d := &corruptDownloader{memDownloader: memDownloader{data: data}, corrupt: 1}
+	o, err := c.Get(testMedia("range-digest", d))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+	buf := make([]byte, 10)
+	if _, err = o.ReadAt(buf, 0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(buf) != data[:10] {
+		t.Fatalf("expecting %q, got %q", data[:10], buf)
+	}
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("cached data does not match source")
+	}
+	if r := d.Requests(); r < 2 {
+		t.Errorf("expecting at least 2 requests, got %d", r)
+	}
+}
+
+func TestCacheCheckChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := testData(3 * DefaultChunkSize)
+	m := testMedia("check", &memDownloader{data: data})
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o, err := c.Get(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Close()
+
+	base := dir + "/" + keyFilename(m.UID)
+	f, err := os.OpenFile(base+dataExt, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f.WriteAt([]byte("corrupt"), DefaultChunkSize+5)
+	f.Close()
+	i, err := readIndex(base + indexExt)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	i.setFlag(flagDirty, true)
+	i.Close()
+
+	if c, err = NewCache(dir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	d := &memDownloader{data: data}
+	if o, err = c.Get(testMedia(m.UID, d)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Errorf("corrupted chunk was not downloaded again")
+	}
+	if r := d.Requests(); r != 1 {
+		t.Errorf("expecting 1 request, got %d", r)
+	}
+}
+
+type concurrentDownloader struct {
+	memDownloader
+	active, max *int
+	mutex       *sync.Mutex
+}
+
+type concurrentReader struct {
+	io.Reader
+	d *concurrentDownloader
+}
+
+func (c *concurrentDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	c.mutex.Lock()
+	*c.active++
+	if *c.active > *c.max {
+		*c.max = *c.active
+	}
+	c.mutex.Unlock()
+	rc, _ := c.memDownloader.NewReadCloser(start, length)
+	return &concurrentReader{Reader: rc, d: c}, nil
+}
+
+func (c *concurrentReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return c.Reader.Read(p)
+}
+
+func (c *concurrentReader) Close() error {
+	c.d.mutex.Lock()
+	*c.d.active--
+	c.d.mutex.Unlock()
+	return nil
+}
+
+func (c *concurrentDownloader) Host() string {
+	return "example.com"
+}
+
+func TestCacheDownloadLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		perObject, perHost, global, objects, max int
+	}{
+		{2, 0, 0, 1, 2},
+		{0, 3, 0, 2, 3},
+		{4, 0, 1, 2, 1},
+	}
+
+	for n, test := range tests {
+		c.SetDownloadLimits(test.perObject, test.perHost, test.global)
+		var (
+			active, max int
+			mutex       sync.Mutex
+			wg          sync.WaitGroup
+		)
+		data := testData(16 * DefaultChunkSize)
+		for i := 0; i < test.objects; i++ {
+			d := &concurrentDownloader{memDownloader: memDownloader{data: data}, active: &active, max: &max, mutex: &mutex}
+			o, err := c.Get(testMedia("limit-"+strconv.Itoa(n)+"-"+strconv.Itoa(i), d))
+			if err != nil {
+				t.Fatalf("test %d: unexpected error: %s", n+1, err)
+			}
+			for j := 15; j >= 0; j -= 3 {
+				wg.Add(1)
+				go func(j int) {
+					defer wg.Done()
+					buf := make([]byte, 10)
+					if _, err := o.ReadAt(buf, int64(j)*DefaultChunkSize); err != nil {
+						t.Errorf("test %d: unexpected error: %s", n+1, err)
+					} else if string(buf) != data[j*DefaultChunkSize:j*DefaultChunkSize+10] {
+						t.Errorf("test %d: read incorrect data", n+1)
+					}
+				}(j)
+			}
+			defer o.Close()
+		}
+		wg.Wait()
+		if max > test.max {
+			t.Errorf("test %d: expecting at most %d concurrent downloads, got %d", n+1, test.max, max)
+		}
+	}
+}
+
+type prefetchDownloader struct {
+	memDownloader
+	allowed map[int64]bool
+	mutex   sync.Mutex
+	started map[int64]bool
+	closed  map[int64]bool
+}
+
+func (p *prefetchDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	p.mutex.Lock()
+	p.started[start] = true
+	p.mutex.Unlock()
+	if p.allowed[start] {
+		return p.memDownloader.NewReadCloser(start, length)
+	}
+	return &prefetchReader{
+		blockingDownloader: blockingDownloader{closed: make(chan struct{})},
+		p:                  p,
+		start:              start,
+	}, nil
+}
+
+func (p *prefetchDownloader) wait(m map[int64]bool, start int64) bool {
+	for i := 0; i < 100; i++ {
+		p.mutex.Lock()
+		ok := m[start]
+		p.mutex.Unlock()
+		if ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+type prefetchReader struct {
+	blockingDownloader
+	p     *prefetchDownloader
+	start int64
+}
+
+func (p *prefetchReader) Close() error {
+	p.p.mutex.Lock()
+	p.p.closed[p.start] = true
+	p.p.mutex.Unlock()
+	return p.blockingDownloader.Close()
+}
+
+func TestCacheReadAhead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	data := testData(32 * DefaultChunkSize)
+	d := &prefetchDownloader{
+		memDownloader: memDownloader{data: data},
+		allowed:       map[int64]bool{16 * DefaultChunkSize: true, 10 * DefaultChunkSize: true},
+		started:       make(map[int64]bool),
+		closed:        make(map[int64]bool),
+	}
+	o, err := c.Get(testMedia("readahead", d))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+
+	buf := make([]byte, 10)
+	o.Seek(16*DefaultChunkSize, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := io.ReadFull(o, buf); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if !d.wait(d.started, 17*DefaultChunkSize) {
+		t.Fatalf("expecting data after sequential reads to be prefetched")
+	}
+	o.Seek(10*DefaultChunkSize, 0)
+	if _, err := io.ReadFull(o, buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(buf) != data[10*DefaultChunkSize:10*DefaultChunkSize+10] {
+		t.Errorf("read incorrect data")
+	}
+	if !d.wait(d.closed, 17*DefaultChunkSize) {
+		t.Errorf("expecting prefetch to be cancelled after seek")
+	}
+}
+
+func TestCacheChunkSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := testData(3*DefaultChunkSize + 123)
+	m := testMedia("chunk-size", &memDownloader{data: data})
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.SetChunkSize(64 * 1024)
+	c.SetAdaptive(time.Second)
+	o, err := c.Get(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("cached data does not match source")
+	}
+	c.Close()
+
+	i, err := readIndex(dir + "/" + keyFilename(m.UID) + indexExt)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	i.Close()
+	if i.chunkSize != 64*1024 {
+		t.Errorf("expecting chunk size %d, got %d", 64*1024, i.chunkSize)
+	}
+	if n := len(i.chunks); n != 25 {
+		t.Errorf("expecting 25 chunks, got %d", n)
+	}
+
+	if c, err = NewCache(dir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	d := &memDownloader{data: data}
+	if o, err = c.Get(testMedia(m.UID, d)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("reloaded data does not match source")
+	}
+	if r := d.Requests(); r != 0 {
+		t.Errorf("expecting no requests to source after reload, got %d", r)
+	}
+}
+
+func TestAdaptiveSpan(t *testing.T) {
+	for n, test := range [...]struct {
+		rate      float64
+		target    time.Duration
+		chunkSize int64
+		span      uint
+	}{
+		{0, 0, DefaultChunkSize, 0},
+		{1 << 30, 0, DefaultChunkSize, 0},
+		{0, time.Second, DefaultChunkSize, 1},
+		{1024, time.Second, DefaultChunkSize, 1},
+		{4 * DefaultChunkSize, time.Second, DefaultChunkSize, 4},
+		{4 * DefaultChunkSize, 2 * time.Second, DefaultChunkSize, 8},
+		{4 * DefaultChunkSize, time.Second, 2 * DefaultChunkSize, 2},
+		{1 << 40, time.Second, DefaultChunkSize, 100},
+	} {
+		sources, err := newSourceSet([]downloader.Downloader{&memDownloader{}}, 0)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+		sources.sources[0].rate = test.rate
+		o := &object{
+			chunkSize: test.chunkSize,
+			opts:      options{adaptive: test.target},
+		}
+		cm := &chunkMap{sources: sources, numChunks: 100}
+		if span := o.span(cm, sources.sources[0]); span != test.span {
+			t.Errorf("test %d: expecting span %d, got %d", n+1, test.span, span)
+		}
+	}
+}
+
+type streamDownloader struct {
+	memDownloader
+}
+
+func (s *streamDownloader) Length() int64 {
+	return downloader.UnknownLength
+}
+
+func TestCacheStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := testData(2*DefaultChunkSize + 123)
+	m := testMedia("stream", &streamDownloader{memDownloader{data: data}})
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o, err := c.Get(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := o.Seek(0, 2); err != nil {
+		if _, ok := err.(UnknownSize); !ok {
+			t.Errorf("expecting UnknownSize error, got %s", err)
+		}
+	}
+	o.Seek(0, 0)
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("cached data does not match source")
+	}
+	if size := o.Size(); size != int64(len(data)) {
+		t.Errorf("expecting size %d, got %d", len(data), size)
+	}
+	o.Close()
+	c.Close()
+
+	if c, err = NewCache(dir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	d := &streamDownloader{memDownloader{data: data}}
+	if o, err = c.Get(testMedia(m.UID, d)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+	if size := o.Size(); size != int64(len(data)) {
+		t.Errorf("expecting size %d after reload, got %d", len(data), size)
+	}
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("reloaded data does not match source")
+	}
+	if r := d.Requests(); r != 0 {
+		t.Errorf("expecting no requests to source after reload, got %d", r)
+	}
+}
+
+type sequentialDownloader struct {
+	memDownloader
+	sequential, ranged bool
+}
+
+func (s *sequentialDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	s.Lock()
+	defer s.Unlock()
+	if start != 0 {
+		s.sequential = true
+		s.ranged = true
+		return nil, io.ErrUnexpectedEOF
+	}
+	if length < 0 || length > int64(len(s.data)) {
+		length = int64(len(s.data))
+	}
+	return ioutil.NopCloser(strings.NewReader(s.data[:length])), nil
+}
+
+func (s *sequentialDownloader) Sequential() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.sequential
+}
+
+func TestCacheSequential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	data := testData(8*DefaultChunkSize + 123)
+	for n, sequential := range [...]bool{true, false} {
+		d := &sequentialDownloader{memDownloader: memDownloader{data: data}, sequential: sequential}
+		o, err := c.Get(testMedia("sequential-"+strconv.Itoa(n), d))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+		buf := make([]byte, 10)
+		if _, err := o.ReadAt(buf, 5*DefaultChunkSize); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(buf) != data[5*DefaultChunkSize:5*DefaultChunkSize+10] {
+			t.Errorf("test %d: read incorrect data", n+1)
+		}
+		if got, err := ioutil.ReadAll(o); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(got) != data {
+			t.Errorf("test %d: cached data does not match source", n+1)
+		}
+		if d.ranged == sequential {
+			t.Errorf("test %d: expecting ranged requests %v, got %v", n+1, !sequential, d.ranged)
+		}
+		o.Close()
+	}
+}
+
+type changingDownloader struct {
+	memDownloader
+	from int64
+}
+
+func (c *changingDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	if start+length > c.from {
+		return nil, downloader.ResourceChanged{}
+	}
+	return c.memDownloader.NewReadCloser(start, length)
+}
+
+func TestCacheChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	data := testData(4*DefaultChunkSize + 123)
+	d := &changingDownloader{memDownloader: memDownloader{data: data}, from: DefaultChunkSize}
+	m := testMedia("changed", d)
+	o, err := c.Get(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	buf := make([]byte, 10)
+	if _, err := o.ReadAt(buf, 3*DefaultChunkSize); err == nil {
+		t.Errorf("expecting error, got nil")
+	} else if _, ok := err.(downloader.ResourceChanged); !ok {
+		t.Errorf("expecting ResourceChanged error, got %s", err)
+	}
+	if _, err := o.ReadAt(buf, 0); err == nil {
+		t.Errorf("expecting error reading previously downloaded data, got nil")
+	}
+	o.Close()
+
+	d2 := &memDownloader{data: data}
+	if o, err = c.Get(testMedia(m.UID, d2)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("cached data does not match source")
+	}
+	if d2.Requests() == 0 {
+		t.Errorf("expecting changed data to be downloaded again")
+	}
+}
+
+type expired struct{}
+
+func (expired) Error() string {
+	return "expired"
+}
+
+func (expired) Expired() bool {
+	return true
+}
+
+type expiringDownloader struct {
+	memDownloader
+	from int64
+}
+
+func (e *expiringDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	if start+length > e.from {
+		return nil, expired{}
+	}
+	return e.memDownloader.NewReadCloser(start, length)
+}
+
+type refreshSite struct {
+	mutex     sync.Mutex
+	refreshes int
+	fresh     *memDownloader
+}
+
+func (*refreshSite) Match(string) bool {
+	return false
+}
+
+func (*refreshSite) Request(string) (*downloader.Request, error) {
+	return nil, downloader.NoRequest{}
+}
+
+func (r *refreshSite) Refresh(_ context.Context, uid string) (downloader.Media, error) {
+	r.mutex.Lock()
+	r.refreshes++
+	r.mutex.Unlock()
+	return testMedia(uid, r.fresh), nil
+}
+
+func TestCacheRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2})
+
+	data := testData(4*DefaultChunkSize + 123)
+	site := &refreshSite{fresh: &memDownloader{data: data}}
+	m := testMedia("refresh", &expiringDownloader{memDownloader: memDownloader{data: data}, from: 2 * DefaultChunkSize})
+	m.Origin = site
+	o, err := c.Get(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, err := ioutil.ReadAll(o); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Errorf("cached data does not match source")
+	}
+	o.Close()
+	if site.refreshes != 1 {
+		t.Errorf("expecting 1 refresh, got %d", site.refreshes)
+	}
+	if site.fresh.Requests() == 0 {
+		t.Errorf("expecting fresh source to be used")
+	}
+
+	m = testMedia("norefresh", &expiringDownloader{memDownloader: memDownloader{data: data}, from: 2 * DefaultChunkSize})
+	if o, err = c.Get(m); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer o.Close()
+	buf := make([]byte, 10)
+	if _, err := o.ReadAt(buf, 3*DefaultChunkSize); err == nil {
+		t.Errorf("expecting error without a Site to refresh from")
+	}
+}
@@ -1,16 +1,28 @@
 package cache
 
-import "io"
+import (
+	"context"
+	"io"
+	"sync"
+)
 
 type RequestReadAtSizer interface {
 	io.ReaderAt
-	Request(int64, int) error
+	Request(context.Context, int64, int) error
 	Size() int64
 }
 
 type CachedObject struct {
-	o   RequestReadAtSizer
-	pos int64
+	o       RequestReadAtSizer
+	id      uint64
+	ctx     context.Context
+	pos     int64
+	release func()
+
+	mutex      sync.Mutex
+	next       int64
+	sequential int
+	ahead      int64
 }
 
 func (c *CachedObject) Read(p []byte) (int, error) {
@@ -20,7 +32,8 @@ func (c *CachedObject) Read(p []byte) (int, error) {
 }
 
 func (c *CachedObject) ReadAt(p []byte, off int64) (int, error) {
-	if err := c.o.Request(off, len(p)); err != nil {
+	c.track(off, len(p))
+	if err := c.o.Request(c.ctx, off, len(p)); err != nil {
 		return 0, err
 	}
 	return c.o.ReadAt(p, off)
@@ -33,7 +46,11 @@ func (c *CachedObject) Seek(offset int64, whence int) (int64, error) {
 	case 1:
 		c.pos += offset
 	case 2:
-		c.pos = c.o.Size() + offset
+		size := c.o.Size()
+		if size < 0 {
+			return c.pos, UnknownSize{}
+		}
+		c.pos = size + offset
 	default:
 		c.pos = 0
 		return 0, UnknownWhence(whence)
@@ -52,15 +69,20 @@ func (c *CachedObject) WriterTo(w io.Writer) (int64, error) {
 		n    int
 	)
 	buf := make([]byte, 32*1024)
-	for c.pos < c.o.Size() {
-		err = c.o.Request(c.pos, len(buf))
+	for {
+		c.track(c.pos, len(buf))
+		err = c.o.Request(c.ctx, c.pos, len(buf))
 		if err != nil {
 			break
 		}
 		n, err = c.o.ReadAt(buf, c.pos)
 		c.pos += int64(n)
+		read += int64(n)
 		_, e := w.Write(buf[:n])
-		if err != nil {
+		if err == io.EOF {
+			err = e
+			break
+		} else if err != nil {
 			break
 		} else if e != nil {
 			err = e
@@ -70,6 +92,57 @@ func (c *CachedObject) WriterTo(w io.Writer) (int64, error) {
 	return read, err
 }
 
+// Size returns the length of the object, or downloader.UnknownLength if it is
+// a stream that has yet to end.
+func (c *CachedObject) Size() int64 {
+	return c.o.Size()
+}
+
+// track detects sequential reads, moving the read-ahead window of the object
+// to the end of each read, and cancelling it when the reader seeks elsewhere.
+func (c *CachedObject) track(off int64, length int) {
+	ra, ok := c.o.(readAheader)
+	if !ok {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if off == c.next {
+		c.sequential++
+	} else {
+		c.sequential = 0
+		if c.ahead != 0 {
+			c.ahead = 0
+			ra.readAhead(c.id, -1)
+		}
+	}
+	c.next = off + int64(length)
+	if c.sequential >= sequentialReads {
+		if chunk := ra.chunk(c.next) + 1; chunk != c.ahead {
+			c.ahead = chunk
+			ra.readAhead(c.id, c.next)
+		}
+	}
+}
+
+// Close releases the CachedObject, allowing the underlying object to be
+// evicted from the cache once it has no other readers.
+func (c *CachedObject) Close() error {
+	c.mutex.Lock()
+	if c.ahead != 0 {
+		c.ahead = 0
+		if ra, ok := c.o.(readAheader); ok {
+			ra.readAhead(c.id, -1)
+		}
+	}
+	c.mutex.Unlock()
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+	return nil
+}
+
 // Errors
 
 type UnknownWhence int
@@ -83,3 +156,11 @@ type NegativeOffset struct{}
 func (NegativeOffset) Error() string {
 	return "can't seek to negative offset"
 }
+
+// UnknownSize is an error returned when seeking relative to the end of a
+// stream whose length is not yet known.
+type UnknownSize struct{}
+
+func (UnknownSize) Error() string {
+	return "size of object is unknown"
+}
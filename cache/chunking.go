@@ -0,0 +1,46 @@
+package cache
+
+import "time"
+
+// SetChunkSize sets the size of the chunks into which objects created after
+// the call are divided. Objects already in the cache keep the chunk size
+// recorded in their index. A size of zero or less restores the default.
+func (c *Cache) SetChunkSize(size int64) {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	c.mutex.Lock()
+	c.opts.chunkSize = size
+	c.mutex.Unlock()
+}
+
+// SetAdaptive enables adaptive chunking, in which the range requested by
+// each download is sized, according to the measured throughput of its
+// source, to take roughly the target duration. The first download from a
+// source requests a single chunk, with later requests growing as the
+// throughput is measured.
+//
+// A target of zero or less disables adaptive chunking, so that each download
+// continues until it reaches data that is already downloaded. The setting
+// applies to objects opened after the call.
+func (c *Cache) SetAdaptive(target time.Duration) {
+	c.mutex.Lock()
+	c.opts.adaptive = target
+	c.mutex.Unlock()
+}
+
+// span returns the number of chunks that a download from the source should
+// request, or zero if it is unlimited.
+func (o *object) span(cm *chunkMap, src *source) uint {
+	if o.opts.adaptive <= 0 {
+		return 0
+	}
+	span := cm.sources.throughput(src) * o.opts.adaptive.Seconds() / float64(o.chunkSize)
+	if span < 1 {
+		return 1
+	}
+	if span > float64(cm.numChunks) {
+		return cm.numChunks
+	}
+	return uint(span)
+}
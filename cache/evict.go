@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"sort"
+	"time"
+)
+
+// Stats contains the usage information about a cached object that is used
+// by a Policy to decide which objects to evict.
+type Stats struct {
+	Key        string
+	Size       int64
+	LastAccess time.Time
+	// Accesses is the number of times the object has been retrieved from the
+	// cache with Get; reads of a retrieved object are not counted.
+	Accesses uint64
+}
+
+// Policy determines the order in which idle objects are evicted when a Cache
+// exceeds its limit.
+type Policy interface {
+	// Less reports whether a should be evicted before b.
+	Less(a, b Stats) bool
+}
+
+// Eviction Policies
+var (
+	// LRU evicts the least recently used objects first.
+	LRU Policy = lru{}
+	// LFU evicts the least frequently used objects first, using recency to
+	// break ties.
+	LFU Policy = lfu{}
+	// SizeWeighted evicts the objects with the most bytes per access first,
+	// using recency to break ties.
+	SizeWeighted Policy = sizeWeighted{}
+)
+
+type lru struct{}
+
+func (lru) Less(a, b Stats) bool {
+	return a.LastAccess.Before(b.LastAccess)
+}
+
+type lfu struct{}
+
+func (lfu) Less(a, b Stats) bool {
+	if a.Accesses == b.Accesses {
+		return a.LastAccess.Before(b.LastAccess)
+	}
+	return a.Accesses < b.Accesses
+}
+
+type sizeWeighted struct{}
+
+func (sizeWeighted) Less(a, b Stats) bool {
+	wa := a.Size / int64(a.Accesses+1)
+	wb := b.Size / int64(b.Accesses+1)
+	if wa == wb {
+		return a.LastAccess.Before(b.LastAccess)
+	}
+	return wa > wb
+}
+
+type evictList struct {
+	stats []Stats
+	Policy
+}
+
+func (e evictList) Len() int {
+	return len(e.stats)
+}
+
+func (e evictList) Less(i, j int) bool {
+	return e.Policy.Less(e.stats[i], e.stats[j])
+}
+
+func (e evictList) Swap(i, j int) {
+	e.stats[i], e.stats[j] = e.stats[j], e.stats[i]
+}
+
+// SetLimit sets the maximum number of bytes the cache should use on disk and
+// the Policy used to choose which objects to evict when that limit is
+// exceeded. A limit of zero or less disables eviction, and a nil Policy
+// defaults to LRU.
+//
+// Objects that have open CachedObjects are never evicted, so the limit may be
+// temporarily exceeded.
+func (c *Cache) SetLimit(limit int64, p Policy) {
+	if p == nil {
+		p = LRU
+	}
+	c.mutex.Lock()
+	c.limit = limit
+	c.policy = p
+	c.evict()
+	c.mutex.Unlock()
+}
+
+// Usage returns the number of bytes of data currently held by the cache.
+func (c *Cache) Usage() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.usage()
+}
+
+func (c *Cache) usage() int64 {
+	var total int64
+	for _, o := range c.objects {
+		total += o.dataSize()
+	}
+	for _, s := range c.stored {
+		total += s.Size
+	}
+	return total
+}
+
+// evict removes idle objects, in the order determined by the Policy, until
+// the cache is within its limit. The mutex must be held when calling.
+func (c *Cache) evict() {
+	if c.limit <= 0 {
+		return
+	}
+	total := c.usage()
+	if total <= c.limit {
+		return
+	}
+	idle := make([]Stats, 0, len(c.objects)+len(c.stored))
+	for key, o := range c.objects {
+		if s, ok := o.idleStats(); ok {
+			s.Key = key
+			idle = append(idle, s)
+		}
+	}
+	for _, s := range c.stored {
+		idle = append(idle, s)
+	}
+	sort.Sort(evictList{idle, c.policy})
+	for _, s := range idle {
+		if total <= c.limit {
+			break
+		}
+		c.remove(s.Key)
+		total -= s.Size
+	}
+}
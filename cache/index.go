@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+// Index flags
+const (
+	// flagDirty is set while an object is open, so that an unclean shutdown
+	// can be detected and the downloaded chunks checked.
+	flagDirty byte = 1 << iota
+	// flagVerified is set once the complete data has been checked against
+	// the Media Digest.
+	flagVerified
+)
+
+const (
+	indexMagic   = "DLCI"
+	indexVersion = 4
+
+	dataExt  = ".data"
+	indexExt = ".index"
+)
+
+// index is the on-disk record that accompanies a cached data file. It
+// records enough information to determine whether the data file is still
+// valid for a given Media and which of its chunks have been downloaded.
+//
+// The access statistics are stored immediately after the flags, and the
+// chunk table at the end of the file, one byte per chunk, followed by a
+// CRC-32C checksum for each chunk, so that updating either is a small write.
+//
+// The checksums are taken from the data as it is written, so they only detect
+// corruption of the data file after that, not errors in the transfer itself;
+// those are caught by the digests supplied by the source.
+type index struct {
+	mutex        sync.Mutex
+	file         *os.File
+	flags        byte
+	accesses     uint64
+	lastAccess   time.Time
+	key          string
+	size         int64
+	chunkSize    int64
+	lastModified time.Time
+	mimeType     string
+	chunks       []byte
+	chunkOffset  int64
+	sums         []byte
+	sumOffset    int64
+}
+
+const (
+	flagsOffset  = int64(len(indexMagic) + 1)
+	accessOffset = flagsOffset + 1
+	headerLength = accessOffset + 16
+)
+
+// keyFilename converts a cache key into a string safe to use as a filename.
+//
+// The key is hashed so that the filename has a fixed length regardless of
+// the key; the key itself is stored in the index.
+func keyFilename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func createIndex(filename, key string, m downloader.Media, size, chunkSize int64) (*index, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	n := numChunks(size, chunkSize)
+	i := &index{
+		file:         f,
+		lastAccess:   time.Now(),
+		key:          key,
+		size:         size,
+		chunkSize:    chunkSize,
+		lastModified: m.LastModified,
+		mimeType:     m.MimeType,
+		chunks:       make([]byte, n),
+		sums:         make([]byte, 4*n),
+	}
+	var buf bytes.Buffer
+	buf.WriteString(indexMagic)
+	buf.WriteByte(indexVersion)
+	buf.WriteByte(i.flags)
+	binary.Write(&buf, binary.LittleEndian, i.accesses)
+	binary.Write(&buf, binary.LittleEndian, i.lastAccess.UnixNano())
+	binary.Write(&buf, binary.LittleEndian, i.size)
+	binary.Write(&buf, binary.LittleEndian, i.chunkSize)
+	binary.Write(&buf, binary.LittleEndian, i.lastModified.Unix())
+	binary.Write(&buf, binary.LittleEndian, int32(i.lastModified.Nanosecond()))
+	writeString(&buf, i.mimeType)
+	writeString(&buf, i.key)
+	i.chunkOffset = int64(buf.Len())
+	buf.Write(i.chunks)
+	i.sumOffset = int64(buf.Len())
+	buf.Write(i.sums)
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return nil, err
+	}
+	return i, nil
+}
+
+func readIndex(filename string) (*index, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	i, err := parseIndex(data)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	i.file = f
+	return i, nil
+}
+
+func parseIndex(data []byte) (*index, error) {
+	if len(data) < int(headerLength) || string(data[:len(indexMagic)]) != indexMagic {
+		return nil, InvalidIndex{}
+	}
+	if data[len(indexMagic)] != indexVersion {
+		return nil, InvalidIndex{}
+	}
+	r := bytes.NewReader(data[headerLength:])
+	var (
+		i    index
+		secs int64
+		nsec int32
+	)
+	i.flags = data[flagsOffset]
+	i.accesses = binary.LittleEndian.Uint64(data[accessOffset:])
+	i.lastAccess = time.Unix(0, int64(binary.LittleEndian.Uint64(data[accessOffset+8:])))
+	if binary.Read(r, binary.LittleEndian, &i.size) != nil ||
+		binary.Read(r, binary.LittleEndian, &i.chunkSize) != nil ||
+		binary.Read(r, binary.LittleEndian, &secs) != nil ||
+		binary.Read(r, binary.LittleEndian, &nsec) != nil {
+		return nil, InvalidIndex{}
+	}
+	i.lastModified = time.Unix(secs, int64(nsec))
+	var ok bool
+	if i.mimeType, ok = readString(r); !ok {
+		return nil, InvalidIndex{}
+	}
+	if i.key, ok = readString(r); !ok {
+		return nil, InvalidIndex{}
+	}
+	i.chunkOffset = int64(len(data) - r.Len())
+	if i.size < 0 || i.chunkSize <= 0 || uint(r.Len()) != 5*numChunks(i.size, i.chunkSize) {
+		return nil, InvalidIndex{}
+	}
+	i.sumOffset = i.chunkOffset + int64(numChunks(i.size, i.chunkSize))
+	i.chunks = data[i.chunkOffset:i.sumOffset]
+	i.sums = data[i.sumOffset:]
+	return &i, nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, bool) {
+	var l uint16
+	if binary.Read(r, binary.LittleEndian, &l) != nil || int(l) > r.Len() {
+		return "", false
+	}
+	b := make([]byte, l)
+	r.Read(b)
+	return string(b), true
+}
+
+// matches determines whether the index describes the given media. A negative
+// size, such as downloader.UnknownLength, matches an index of any size.
+func (i *index) matches(m downloader.Media, size int64) bool {
+	return (i.size == size || size < 0) && i.lastModified.Equal(m.LastModified) && i.mimeType == m.MimeType
+}
+
+func (i *index) done(chunk uint) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.chunks[chunk] != 0
+}
+
+func (i *index) sum(chunk uint) uint32 {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return binary.LittleEndian.Uint32(i.sums[4*chunk:])
+}
+
+// setDone marks a chunk as complete, recording its checksum, both in memory
+// and on disk.
+func (i *index) setDone(chunk uint, sum uint32) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	s := i.sums[4*chunk : 4*chunk+4]
+	binary.LittleEndian.PutUint32(s, sum)
+	if _, err := i.file.WriteAt(s, i.sumOffset+int64(4*chunk)); err != nil {
+		return err
+	}
+	i.chunks[chunk] = 1
+	_, err := i.file.WriteAt(i.chunks[chunk:chunk+1], i.chunkOffset+int64(chunk))
+	return err
+}
+
+// clear marks a chunk as needing to be downloaded again, which also means
+// that the complete data will need to be verified again.
+func (i *index) clear(chunk uint) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if err := i.writeFlag(flagVerified, false); err != nil {
+		return err
+	}
+	i.chunks[chunk] = 0
+	_, err := i.file.WriteAt(i.chunks[chunk:chunk+1], i.chunkOffset+int64(chunk))
+	return err
+}
+
+// setAccess records the access statistics of the object, so that they
+// survive it being closed.
+func (i *index) setAccess(accesses uint64, lastAccess time.Time) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.accesses = accesses
+	i.lastAccess = lastAccess
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:], accesses)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(lastAccess.UnixNano()))
+	_, err := i.file.WriteAt(buf[:], accessOffset)
+	return err
+}
+
+func (i *index) hasFlag(flag byte) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.flags&flag != 0
+}
+
+func (i *index) setFlag(flag byte, on bool) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.writeFlag(flag, on)
+}
+
+func (i *index) writeFlag(flag byte, on bool) error {
+	flags := i.flags &^ flag
+	if on {
+		flags |= flag
+	}
+	if flags == i.flags {
+		return nil
+	}
+	i.flags = flags
+	_, err := i.file.WriteAt([]byte{flags}, flagsOffset)
+	return err
+}
+
+func (i *index) Close() error {
+	return i.file.Close()
+}
+
+// Errors
+
+// InvalidIndex is an error returned when an index file cannot be parsed.
+type InvalidIndex struct{}
+
+func (InvalidIndex) Error() string {
+	return "invalid cache index"
+}
@@ -1,9 +1,15 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/MJKWoolnough/boolmap"
 	"github.com/MJKWoolnough/downloader"
@@ -16,212 +22,976 @@ type request struct {
 }
 
 type object struct {
-	req  chan request
-	quit chan struct{}
-	size int64
-	file *os.File
+	req       chan request
+	prefetch  chan prefetch
+	quit      chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	size      int64
+	chunkSize int64
+	file      *os.File
+	index     *index
+	digest    downloader.Digest
+	uid       string
+	origin    downloader.Site
+	opts      options
+	// stream is set for objects of unknown length.
+	stream *stream
+
+	mutex      sync.Mutex
+	readers    int
+	readerID   uint64
+	accesses   uint64
+	lastAccess time.Time
+	// stale is set once a source reports that the data has changed, after
+	// which the object can make no further progress.
+	stale bool
+}
+
+// DefaultChunkSize is the size of the chunks into which objects are divided
+// when no other size has been set.
+const DefaultChunkSize = 512 * 1024
+
+// maxDigestAttempts is the number of times an object is completely
+// downloaded before giving up when it doesn't match the Media Digest.
+const maxDigestAttempts = 2
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkLength returns the length of the given chunk, which is only shorter
+// than the chunk size for the last chunk.
+func (o *object) chunkLength(chunk uint) int64 {
+	if l := o.size - int64(chunk)*o.chunkSize; l < o.chunkSize {
+		return l
+	}
+	return o.chunkSize
 }
 
-const chunkSize = 512 * 1024
+func numChunks(size, chunkSize int64) uint {
+	n := uint(size / chunkSize)
+	if size%chunkSize > 0 {
+		n++
+	}
+	return n
+}
 
-func newObject(filename string, r downloader.Downloader) (*object, error) {
-	f, err := os.Create(filename)
+// newObject opens the cached data at the given base filename, resuming from
+// the existing index when it matches the media, or creating it anew.
+func newObject(base string, m downloader.Media, opts options) (*object, error) {
+	size := m.Size
+	if size <= 0 {
+		size = m.Sources[0].Length()
+	}
+	r, err := newSourceSet(m.Sources, size)
+	if err != nil {
+		return nil, err
+	}
+	i, err := readIndex(base + indexExt)
+	if err == nil {
+		if i.matches(m, size) {
+			f, err := os.OpenFile(base+dataExt, os.O_RDWR, 0)
+			if err == nil {
+				return startObject(f, i, r, m, opts), nil
+			}
+		}
+		i.Close()
+	}
+	f, err := os.Create(base + dataExt)
 	if err != nil {
 		return nil, err
 	}
-	if err = preallocate(f, r.Length()); err != nil {
+	if size < 0 {
+		// The index is only completed once the length is known; until
+		// then it will be treated as invalid, and removed, by NewCache.
+		if i, err = createIndex(base+indexExt, m.UID, m, size, opts.chunkSize); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return startObject(f, i, r, m, opts), nil
+	}
+	if err = preallocate(f, size); err != nil {
+		f.Close()
 		return nil, err
 	}
-	if err = os.Remove(filename); err != nil {
+	i, err = createIndex(base+indexExt, m.UID, m, size, opts.chunkSize)
+	if err != nil {
+		f.Close()
 		return nil, err
 	}
+	return startObject(f, i, r, m, opts), nil
+}
+
+func startObject(f *os.File, i *index, r *sourceSet, m downloader.Media, opts options) *object {
+	ctx, cancel := context.WithCancel(context.Background())
 	o := &object{
-		req:  make(chan request),
-		quit: make(chan struct{}),
-		size: r.Length(),
-		file: f,
+		req:       make(chan request),
+		prefetch:  make(chan prefetch),
+		quit:      make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		size:      i.size,
+		chunkSize: i.chunkSize,
+		file:      f,
+		index:     i,
+		digest:    m.Digest,
+		uid:       m.UID,
+		origin:    m.Origin,
+		opts:      opts,
+
+		lastAccess: time.Now(),
 	}
-	go o.taskMaster(r)
-	return o, nil
+	if i.size < 0 {
+		o.stream = newStream()
+		go o.streamer(r)
+	} else {
+		go o.taskMaster(r)
+	}
+	return o
+}
+
+// open registers a new reader of the object, returning an identifier for it.
+func (o *object) open() uint64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.readers++
+	o.readerID++
+	o.accesses++
+	o.lastAccess = time.Now()
+	o.saveAccess()
+	return o.readerID
+}
+
+func (o *object) release() {
+	o.mutex.Lock()
+	o.readers--
+	o.lastAccess = time.Now()
+	o.saveAccess()
+	o.mutex.Unlock()
+}
+
+// saveAccess records the access statistics in the index. The mutex must be
+// held when calling.
+func (o *object) saveAccess() {
+	o.index.setAccess(o.accesses, o.lastAccess)
+}
+
+func (o *object) stats() Stats {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return Stats{
+		Size:       o.dataSize(),
+		LastAccess: o.lastAccess,
+		Accesses:   o.accesses,
+	}
+}
+
+// idleStats returns the stats of the object if it has no open readers.
+func (o *object) idleStats() (Stats, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.readers > 0 {
+		return Stats{}, false
+	}
+	return Stats{
+		Size:       o.dataSize(),
+		LastAccess: o.lastAccess,
+		Accesses:   o.accesses,
+	}, true
+}
+
+// staleStats returns the stats of the object if its data has changed and it
+// has no open readers.
+func (o *object) staleStats() (Stats, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.readers > 0 || !o.stale {
+		return Stats{}, false
+	}
+	return Stats{
+		Size:       o.dataSize(),
+		LastAccess: o.lastAccess,
+		Accesses:   o.accesses,
+	}, true
+}
+
+func (o *object) close() {
+	o.cancel()
+	o.mutex.Lock()
+	o.saveAccess()
+	o.mutex.Unlock()
+	if o.file.Sync() == nil {
+		o.index.setFlag(flagDirty, false)
+	}
+	o.file.Close()
+	o.index.Close()
 }
 
 func (o *object) ReadAt(b []byte, offset int64) (int, error) {
 	return o.file.ReadAt(b, offset)
 }
 
+// Size returns the length of the object, or downloader.UnknownLength for a
+// stream that has yet to end.
 func (o *object) Size() int64 {
+	if o.stream != nil {
+		return o.stream.size()
+	}
 	return o.size
 }
 
-func (o *object) Request(start int64, length int) error {
+// dataSize returns the number of bytes of data held for the object.
+func (o *object) dataSize() int64 {
+	if o.stream != nil {
+		return o.stream.progress()
+	}
+	return o.size
+}
+
+func (o *object) Request(ctx context.Context, start int64, length int) error {
+	o.mutex.Lock()
+	o.lastAccess = time.Now()
+	o.mutex.Unlock()
+	if o.stream != nil {
+		return o.stream.wait(ctx, o.quit, start+int64(length))
+	}
+	if start >= o.size || length <= 0 {
+		return nil
+	}
+	end := start + int64(length)
+	if end > o.size {
+		end = o.size
+	}
 	req := request{
-		startChunk: uint(start / chunkSize),
-		endChunk:   uint((start + int64(length)) / chunkSize),
-		c:          make(chan error),
+		startChunk: uint(start / o.chunkSize),
+		endChunk:   uint((end - 1) / o.chunkSize),
+		c:          make(chan error, 1),
 	}
-	defer close(req.c)
 	select {
 	case o.req <- req:
-		err := <-req.c
-		return err
 	case <-o.quit:
 		return ObjectRemoved{}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.c:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (o *object) taskMaster(r downloader.Downloader) {
-	size := r.Length()
-	numChunks := size / chunkSize
-	if size%chunkSize > 0 {
-		numChunks++
-	}
-	ctx := &context{
-		Downloader:     r,
+func (o *object) taskMaster(r *sourceSet) {
+	n := numChunks(o.size, o.chunkSize)
+	cm := &chunkMap{
+		sources:        r,
 		chunkDone:      make(chan uint),
-		downloaderDone: make(chan struct{}),
-		crumbslice:     boolmap.NewCrumbSliceSize(uint(numChunks)),
-		numChunks:      uint(numChunks),
+		downloaderDone: make(chan downloadResult),
+		retry:          make(chan uint),
+		refreshed:      make(chan error),
+		verified:       make(chan bool),
+		crumbslice:     boolmap.NewCrumbSliceSize(n),
+		numChunks:      n,
+		attempts:       make(map[uint]int),
+		failed:         make(map[uint]error),
+		waiter:         newSlotWaiter(),
+		downloads:      make(map[uint]*activeDownload),
+		sequential:     r.sequential(),
+	}
+	if o.index.hasFlag(flagDirty) {
+		o.checkChunks(n)
+	}
+	o.index.setFlag(flagDirty, true)
+	for i := uint(0); i < n; i++ {
+		if o.index.done(i) {
+			cm.Set(i, 2)
+		}
 	}
 
 	requests := make([]request, 0, 32)
 
-	ctx.Set(0, 1)
-	go o.download(ctx, 0)
-	running := 1
+	running := 0
+	if o.next(cm) || o.verify(cm) {
+		running++
+	}
 
-downloadLoop:
-	for {
+	for running > 0 {
 		select {
 		case req := <-o.req:
-			for i := req.startChunk; i <= req.endChunk; i++ {
-				if ctx.GetCompareSet(i, 0, 1) {
-					requests = append(requests, req)
-					go o.download(ctx, i)
-					running++
-					continue downloadLoop
-				} else if ctx.Get(i) == 1 {
-					requests = append(requests, req)
-					continue downloadLoop
-				}
+			running += o.fetch(cm, req)
+			if cm.settled(req) {
+				req.c <- cm.requestErr(req)
+			} else {
+				requests = append(requests, req)
 			}
-			req.c <- nil
-		case chunk := <-ctx.chunkDone:
-		checkRequestLoop:
-			for i := 0; i < len(requests); i++ {
-				req := requests[i]
-				if req.startChunk <= chunk && req.endChunk >= chunk {
-					for j := req.startChunk; j <= req.endChunk; j++ {
-						if ctx.Get(j) != 2 {
-							continue checkRequestLoop
-						}
+			o.dispatch(cm)
+		case p := <-o.prefetch:
+			running += o.moveWindow(cm, p)
+		case chunk := <-cm.chunkDone:
+			cm.refreshes = 0
+			cm.progress(chunk)
+			requests = cm.answer(requests, chunk)
+		case res := <-cm.downloaderDone:
+			running--
+			cm.active--
+			d := cm.downloads[res.start]
+			delete(cm.downloads, res.start)
+			d.cancel()
+			if cm.changed && d.cancelled {
+				o.fail(cm, d.start, d.end, downloader.ResourceChanged{})
+			} else if res.err != nil {
+				if d.cancelled {
+					cm.Set(res.chunk, 0)
+				} else if _, ok := res.err.(downloader.ResourceChanged); ok {
+					running += o.changed(cm)
+					for _, req := range requests {
+						req.c <- cm.requestErr(req)
 					}
-					req.c <- nil
-					requests[i] = requests[len(requests)-1]
-					requests = requests[:len(requests)-1]
-					i--
+					requests = requests[:0]
+				} else if o.canRefresh(cm, res.err) {
+					cm.Set(res.chunk, 0)
+					running++
+					o.refresh(cm)
+				} else if cm.refreshing && downloader.IsExpired(res.err) {
+					cm.Set(res.chunk, 0)
+				} else if !cm.sequential && cm.sources.sequential() {
+					cm.Set(res.chunk, 0)
+					running += o.linear(cm)
+				} else if o.retry(cm, res) {
+					running++
+				} else {
+					requests = cm.answer(requests, res.chunk)
 				}
 			}
-		case <-ctx.downloaderDone:
+			for _, req := range requests {
+				running += o.fetch(cm, req)
+			}
+			o.dispatch(cm)
+		case err := <-cm.refreshed:
 			running--
-			if running == 0 {
-				for i := uint(0); i <= uint(o.size/chunkSize); i++ {
-					if ctx.GetCompareSet(i, 0, 1) {
-						running++
-						go o.download(ctx, i)
-						break
-					}
+			cm.refreshing = false
+			if err != nil {
+				cm.refreshErr = err
+			}
+			for _, req := range requests {
+				running += o.fetch(cm, req)
+			}
+			o.dispatch(cm)
+		case chunk := <-cm.retry:
+			cm.schedule(queued{
+				chunk:    chunk,
+				limit:    cm.numChunks,
+				priority: priorityRetry,
+			})
+			o.dispatch(cm)
+		case <-cm.waiter.signal:
+			for _, host := range o.opts.slots.granted(cm.waiter) {
+				if len(cm.queue) > 0 && o.canStart(cm) {
+					o.start(cm, cm.top(), host)
+				} else {
+					o.opts.slots.release(host)
 				}
 			}
-			if running == 0 {
-				for _, req := range requests {
-					req.c <- nil
+			o.dispatch(cm)
+		case ok := <-cm.verified:
+			running--
+			if ok {
+				o.index.setFlag(flagVerified, true)
+			} else if cm.digestAttempts < maxDigestAttempts {
+				for i := uint(0); i < n; i++ {
+					o.index.clear(i)
+					cm.Set(i, 0)
+				}
+			} else {
+				for i := uint(0); i < n; i++ {
+					cm.failed[i] = downloader.DigestMismatch{}
+					cm.Set(i, 3)
 				}
-				close(ctx.downloaderDone)
-				close(ctx.chunkDone)
-				break downloadLoop
 			}
 		case <-o.quit:
-			o.file.Close()
+			o.opts.slots.cancel(cm.waiter)
+			o.close()
 			for _, req := range requests {
 				req.c <- ObjectRemoved{}
 			}
 			return
 		}
+		if running == 0 && (o.next(cm) || o.verify(cm)) {
+			running++
+		}
+	}
+	o.opts.slots.cancel(cm.waiter)
+	for _, req := range requests {
+		req.c <- cm.requestErr(req)
 	}
 	for {
 		select {
 		case req := <-o.req:
-			req.c <- nil
+			req.c <- cm.requestErr(req)
+		case <-o.prefetch:
 		case <-o.quit:
-			o.file.Close()
+			o.close()
 			return
 		}
 	}
 }
 
-func (o *object) download(ctx *context, start uint) {
-	defer func() {
-		ctx.downloaderDone <- struct{}{}
+// linear switches the object to a single sequential download, once it has
+// been found that none of the sources can download arbitrary ranges. Queued
+// downloads are dropped, and running ones cancelled, in favour of a download
+// of the first missing chunk that continues to the end of the data. It
+// returns the change in the number of outstanding downloads.
+func (o *object) linear(cm *chunkMap) int {
+	cm.sequential = true
+	n := o.abandon(cm)
+	if o.next(cm) {
+		n++
+	}
+	return n
+}
+
+// changed fails every chunk of the object once a source reports that the
+// data has changed, clearing the index so that it will be downloaded anew
+// when next opened. It returns the change in the number of outstanding
+// downloads.
+func (o *object) changed(cm *chunkMap) int {
+	cm.changed = true
+	o.mutex.Lock()
+	o.stale = true
+	o.mutex.Unlock()
+	n := o.abandon(cm)
+	o.fail(cm, 0, cm.numChunks, downloader.ResourceChanged{})
+	return n
+}
+
+// fail clears the chunks from start up to, but not including, end from the
+// index, and marks them as failed with the given error.
+func (o *object) fail(cm *chunkMap, start, end uint, err error) {
+	for i := start; i < end; i++ {
+		o.index.clear(i)
+		cm.failed[i] = err
+		cm.Set(i, 3)
+	}
+}
+
+// abandon drops all queued downloads and cancels those that are running,
+// returning the change in the number of outstanding downloads.
+func (o *object) abandon(cm *chunkMap) int {
+	n := -len(cm.queue)
+	for _, q := range cm.queue {
+		cm.Set(q.chunk, 0)
+	}
+	cm.queue = cm.queue[:0]
+	for _, d := range cm.downloads {
+		if !d.cancelled {
+			d.cancelled = true
+			d.cancel()
+		}
+	}
+	return n
+}
+
+// next queues a download of the first chunk that has yet to be downloaded,
+// returning false if there are none.
+func (o *object) next(cm *chunkMap) bool {
+	for i := uint(0); i < cm.numChunks; i++ {
+		if cm.GetCompareSet(i, 0, 1) {
+			cm.schedule(queued{
+				chunk:    i,
+				limit:    cm.numChunks,
+				priority: priorityBackground,
+			})
+			o.dispatch(cm)
+			return true
+		}
+	}
+	return false
+}
+
+func (o *object) canStart(cm *chunkMap) bool {
+	if cm.refreshing {
+		return false
+	} else if cm.sequential {
+		return cm.active == 0
+	}
+	return o.opts.maxDownloads <= 0 || cm.active < o.opts.maxDownloads
+}
+
+// dispatch starts queued downloads, in priority order, for as long as there
+// are download slots available. If the Cache has no slots available, the
+// object waits for one to be granted.
+func (o *object) dispatch(cm *chunkMap) {
+	for len(cm.queue) > 0 && o.canStart(cm) {
+		t := cm.top()
+		host, ok := o.opts.slots.acquire(cm.waiter, cm.sources.hosts(), cm.queue[t].priority)
+		if !ok {
+			return
+		}
+		o.start(cm, t, host)
+	}
+	o.opts.slots.cancel(cm.waiter)
+}
+
+// fetch queues downloads for any of the chunks of a request that are not
+// already downloading, and makes sure that those that are, are not cancelled.
+// It returns the number of downloads queued.
+func (o *object) fetch(cm *chunkMap, req request) int {
+	var n int
+	for i := req.startChunk; i <= req.endChunk; i++ {
+		switch cm.Get(i) {
+		case 0:
+			if !cm.sequential && !cm.covered(i, o.window()) && cm.GetCompareSet(i, 0, 1) {
+				cm.schedule(queued{
+					chunk:    i,
+					limit:    req.endChunk + 1,
+					priority: priorityRequested,
+				})
+				n++
+				continue
+			}
+			fallthrough
+		case 1:
+			cm.promote(i)
+		}
+	}
+	return n
+}
+
+// start removes the queued download from the queue and starts it using a
+// source for the host whose slot has been acquired. The download continues
+// until the queued limit, or the next chunk that is not missing, unless
+// limited by adaptive chunking.
+func (o *object) start(cm *chunkMap, t int, host string) {
+	q := cm.dequeue(t)
+	src := cm.sources.get(host)
+	limit := q.limit
+	if span := o.span(cm, src); span > 0 && q.chunk+span < limit {
+		limit = q.chunk + span
+	}
+	end := q.chunk + 1
+	if cm.sequential {
+		end = cm.numChunks
+	}
+	for end < limit && cm.Get(end) == 0 {
+		end++
+	}
+	ctx, cancel := context.WithCancel(o.ctx)
+	cm.downloads[q.chunk] = &activeDownload{
+		start:  q.chunk,
+		next:   q.chunk,
+		end:    end,
+		reader: q.reader,
+		cancel: cancel,
+	}
+	cm.active++
+	go o.download(ctx, cm, q.chunk, end, src, cm.sequential)
+}
+
+// checkChunks compares each downloaded chunk against its recorded checksum,
+// marking those that differ to be downloaded again.
+func (o *object) checkChunks(n uint) {
+	buf := make([]byte, o.chunkSize)
+	for i := uint(0); i < n; i++ {
+		if !o.index.done(i) {
+			continue
+		}
+		l, err := o.file.ReadAt(buf, int64(i)*o.chunkSize)
+		if err == io.EOF && l > 0 {
+			err = nil
+		}
+		if err != nil || crc32.Checksum(buf[:l], crcTable) != o.index.sum(i) {
+			o.index.clear(i)
+		}
+	}
+}
+
+// verify starts checking the complete data against the Media Digest,
+// returning false if there is nothing to check.
+func (o *object) verify(cm *chunkMap) bool {
+	if o.digest.Sum == nil || len(cm.failed) > 0 || cm.digestAttempts >= maxDigestAttempts || o.index.hasFlag(flagVerified) {
+		return false
+	}
+	h := o.digest.NewHash()
+	if h == nil {
+		return false
+	}
+	cm.digestAttempts++
+	go func() {
+		_, err := io.Copy(h, io.NewSectionReader(o.file, 0, o.size))
+		select {
+		case cm.verified <- err == nil && bytes.Equal(h.Sum(nil), o.digest.Sum):
+		case <-o.quit:
+		}
 	}()
-	var end uint
-	for end = start + 1; end <= ctx.numChunks; end++ {
-		if ctx.Get(end) != 0 {
-			break
+	return true
+}
+
+// invalidate marks the given range of chunks as needing to be downloaded
+// again, leaving the first chunk in progress so that it can be retried.
+func (o *object) invalidate(cm *chunkMap, start, end uint) {
+	for i := start; i <= end; i++ {
+		o.index.clear(i)
+		cm.Set(i, 0)
+	}
+	cm.Set(start, 1)
+}
+
+// retry schedules another attempt at downloading a failed chunk, returning
+// false, and marking the chunk as failed, when the retry policy has been
+// exhausted.
+func (o *object) retry(cm *chunkMap, res downloadResult) bool {
+	cm.attempts[res.chunk]++
+	attempts := cm.attempts[res.chunk]
+	if attempts >= o.opts.retry.MaxAttempts || o.ctx.Err() != nil {
+		cm.failed[res.chunk] = DownloadError{
+			Offset: int64(res.chunk) * o.chunkSize,
+			Err:    res.err,
 		}
+		cm.Set(res.chunk, 3)
+		return false
 	}
+	time.AfterFunc(o.opts.retry.delay(attempts), func() {
+		select {
+		case cm.retry <- res.chunk:
+		case <-o.quit:
+		}
+	})
+	return true
+}
 
-	rc, err := ctx.NewReadCloser(int64(start*chunkSize), int64((start-end)*chunkSize))
+// download retrieves the chunks from start up to, but not including, end,
+// stopping early if it reaches a chunk that is already being downloaded. The
+// start chunk must already be marked as in progress and remains so if the
+// download fails, so that the taskMaster can decide whether to retry it.
+//
+// A sequential download reads the data from the beginning, skipping over
+// chunks that are already downloaded rather than stopping at them.
+func (o *object) download(ctx context.Context, cm *chunkMap, start, end uint, src *source, sequential bool) {
+	res := downloadResult{start: start, chunk: start}
+	began := time.Now()
+	var read int64
+	defer func() {
+		if ctx.Err() != nil {
+			cm.sources.cancelled(src)
+		} else {
+			cm.sources.measure(src, read, time.Since(began))
+			cm.sources.done(src, res.err)
+		}
+		o.opts.slots.release(src.host)
+		select {
+		case cm.downloaderDone <- res:
+		case <-o.quit:
+		}
+	}()
+	from := start
+	if sequential {
+		from = 0
+	}
+	rc, err := downloader.NewReadCloserContext(ctx, src, int64(from)*o.chunkSize, int64(end-from)*o.chunkSize)
 	if err != nil {
-		ctx.Set(start, 0)
+		res.err = err
 		return
 	}
 	defer rc.Close()
-	buf := make([]byte, chunkSize)
+	// When the data is checked against a digest of the range, the chunks
+	// are held in progress until the end has been reached and the check
+	// passed, so that no reader is served unverified data.
+	verifying := downloader.IsVerifying(rc)
+	var (
+		held []uint
+		sums []uint32
+	)
+	buf := make([]byte, o.chunkSize)
 	w := memio.Create(&buf)
-	for chunk := start; chunk < end; chunk++ {
-		if !ctx.GetCompareSet(chunk, 0, 1) && chunk != start {
-			return
+	for chunk := from; chunk < end; chunk++ {
+		if chunk != start && !cm.GetCompareSet(chunk, 0, 1) {
+			if !sequential {
+				drop(cm, held, end)
+				return
+			}
+			n, err := io.CopyN(ioutil.Discard, rc, o.chunkLength(chunk))
+			read += n
+			if err != nil {
+				drop(cm, held, res.chunk)
+				res.err = err
+				return
+			}
+			continue
 		}
+		res.chunk = chunk
 		w.Seek(0, 0)
-		n, err := io.CopyN(w, rc, chunkSize)
-		if err == io.EOF && chunk == ctx.numChunks-1 && n == ctx.Length()%chunkSize {
+		n, err := io.CopyN(w, rc, o.chunkSize)
+		read += n
+		if err == io.EOF && chunk == cm.numChunks-1 && n == o.size%o.chunkSize {
 			err = nil
-		} else if err != nil {
-			ctx.Set(chunk, 0)
-			return
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			_, err = o.file.WriteAt(buf[:n], int64(chunk)*o.chunkSize)
 		}
-		_, err = o.file.WriteAt(buf[:n], int64(chunk*chunkSize))
 		if err != nil {
-			ctx.Set(chunk, 0)
+			if _, ok := err.(downloader.DigestMismatch); ok {
+				o.invalidate(cm, start, chunk)
+				res.chunk = start
+			} else {
+				drop(cm, held, chunk)
+			}
+			res.err = err
 			return
 		}
-		ctx.Set(chunk, 2)
-		ctx.chunkDone <- chunk
+		held = append(held, chunk)
+		sums = append(sums, crc32.Checksum(buf[:n], crcTable))
+		if !verifying {
+			if res.err = o.commit(cm, held, sums); res.err != nil {
+				return
+			}
+			held, sums = held[:0], sums[:0]
+		}
+	}
+	if !verifying {
+		return
+	}
+	if _, err := io.CopyN(ioutil.Discard, rc, 1); err == io.EOF {
+		if res.err = o.commit(cm, held, sums); res.err != nil {
+			for _, chunk := range held {
+				if cm.Get(chunk) == 1 {
+					res.chunk = chunk
+					break
+				}
+			}
+		}
+	} else if _, ok := err.(downloader.DigestMismatch); ok {
+		o.invalidate(cm, start, end-1)
+		res.chunk = start
+		res.err = err
+	} else {
+		drop(cm, held, end)
 	}
 }
 
-type context struct {
-	downloader.Downloader
+// commit marks the given chunks as done, recording their checksums, and
+// notifies the taskMaster of each. On error, the failed chunk remains in
+// progress and those after it are returned to missing.
+func (o *object) commit(cm *chunkMap, chunks []uint, sums []uint32) error {
+	for n, chunk := range chunks {
+		if err := o.index.setDone(chunk, sums[n]); err != nil {
+			drop(cm, chunks[n+1:], chunk)
+			return err
+		}
+		cm.Set(chunk, 2)
+		select {
+		case cm.chunkDone <- chunk:
+		case <-o.quit:
+			return nil
+		}
+	}
+	return nil
+}
+
+// drop returns chunks that were held in progress, other than keep, to
+// missing so that they will be downloaded again.
+func drop(cm *chunkMap, chunks []uint, keep uint) {
+	for _, chunk := range chunks {
+		if chunk != keep {
+			cm.Set(chunk, 0)
+		}
+	}
+}
+
+// queued is a chunk waiting for a download slot. When started, the download
+// continues up to limit while the following chunks are missing.
+type queued struct {
+	chunk, limit uint
+	priority     int
+	seq          uint64
+	// reader identifies the CachedObject for which a speculative read-ahead
+	// download was queued. It is zero for all other downloads.
+	reader uint64
+}
+
+// activeDownload describes a running download.
+type activeDownload struct {
+	start, next, end uint
+	reader           uint64
+	cancel           context.CancelFunc
+	cancelled        bool
+}
+
+type downloadResult struct {
+	start, chunk uint
+	err          error
+}
+
+// chunkMap tracks the state of each chunk of an object. A chunk is in one of
+// four states: 0 (missing), 1 (downloading), 2 (done) or 3 (failed).
+//
+// The attempts and failed maps, and the download queue, are only accessed by
+// the taskMaster.
+type chunkMap struct {
+	sources        *sourceSet
 	chunkDone      chan uint
-	downloaderDone chan struct{}
+	downloaderDone chan downloadResult
+	retry          chan uint
+	verified       chan bool
+	digestAttempts int
 	crumbslice     *boolmap.CrumbSlice
 	mutex          sync.RWMutex
 	numChunks      uint
+	attempts       map[uint]int
+	failed         map[uint]error
+	queue          []queued
+	seq            uint64
+	active         int
+	waiter         *slotWaiter
+	downloads      map[uint]*activeDownload
+	// sequential is set when the sources can only be read from the start,
+	// so that only a single download, which skips over the chunks already
+	// downloaded, can run at a time.
+	sequential bool
+	// changed is set when a source reports that the data has changed.
+	changed bool
+	// refreshing is set while fresh sources are being found to replace
+	// expired ones, during which no downloads are started. refreshes
+	// counts the refreshes since a chunk was last downloaded, and
+	// refreshErr records why the last refresh failed.
+	refreshing bool
+	refreshes  int
+	refreshErr error
+	refreshed  chan error
+}
+
+// schedule adds a download, whose first chunk must already be marked as in
+// progress, to the queue.
+func (c *chunkMap) schedule(q queued) {
+	q.seq = c.seq
+	c.seq++
+	c.queue = append(c.queue, q)
+}
+
+func (c *chunkMap) dequeue(t int) queued {
+	q := c.queue[t]
+	c.queue[t] = c.queue[len(c.queue)-1]
+	c.queue = c.queue[:len(c.queue)-1]
+	return q
+}
+
+// covered determines whether a missing chunk will soon be reached by a
+// queued or running download, that is, within the given number of chunks.
+func (c *chunkMap) covered(chunk, within uint) bool {
+	for _, q := range c.queue {
+		if q.chunk <= chunk && chunk < q.limit && chunk-q.chunk < within && c.missing(q.chunk+1, chunk) {
+			return true
+		}
+	}
+	for _, d := range c.downloads {
+		if !d.cancelled && d.next <= chunk && chunk < d.end && chunk-d.next < within && c.missing(d.next+1, chunk) {
+			return true
+		}
+	}
+	return false
+}
+
+// missing determines whether all of the chunks from start up to, but not
+// including, end are missing.
+func (c *chunkMap) missing(start, end uint) bool {
+	for i := start; i < end; i++ {
+		if c.Get(i) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// promote makes the queued, or running, downloads that include a chunk
+// non-speculative, as it has been requested by a reader.
+func (c *chunkMap) promote(chunk uint) {
+	for n, q := range c.queue {
+		if q.chunk <= chunk && chunk < q.limit && q.priority > priorityRequested {
+			c.queue[n].priority = priorityRequested
+			c.queue[n].reader = 0
+		}
+	}
+	for _, d := range c.downloads {
+		if !d.cancelled && d.start <= chunk && chunk < d.end {
+			d.reader = 0
+		}
+	}
+}
+
+// progress records that a chunk of a running download has completed.
+func (c *chunkMap) progress(chunk uint) {
+	for _, d := range c.downloads {
+		if d.next == chunk {
+			d.next++
+		}
+	}
 }
 
-func (c *context) Get(p uint) byte {
+// top returns the position in the queue of the highest priority chunk.
+func (c *chunkMap) top() int {
+	t := 0
+	for n, q := range c.queue {
+		if q.priority < c.queue[t].priority || (q.priority == c.queue[t].priority && q.seq < c.queue[t].seq) {
+			t = n
+		}
+	}
+	return t
+}
+
+// settled determines whether all of the chunks for a request are either
+// done, or whether any of them have failed.
+func (c *chunkMap) settled(req request) bool {
+	for i := req.startChunk; i <= req.endChunk; i++ {
+		switch c.Get(i) {
+		case 2:
+		case 3:
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestErr returns the error, if any, for a settled request.
+func (c *chunkMap) requestErr(req request) error {
+	for i := req.startChunk; i <= req.endChunk; i++ {
+		if err, ok := c.failed[i]; ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// answer responds to, and removes, each settled request that contains the
+// given chunk.
+func (c *chunkMap) answer(requests []request, chunk uint) []request {
+	for i := 0; i < len(requests); i++ {
+		req := requests[i]
+		if req.startChunk <= chunk && req.endChunk >= chunk && c.settled(req) {
+			req.c <- c.requestErr(req)
+			requests[i] = requests[len(requests)-1]
+			requests = requests[:len(requests)-1]
+			i--
+		}
+	}
+	return requests
+}
+
+func (c *chunkMap) Get(p uint) byte {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 	return c.crumbslice.Get(p)
 }
 
-func (c *context) Set(p uint, d byte) {
+func (c *chunkMap) Set(p uint, d byte) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.crumbslice.Set(p, d)
 }
 
-func (c *context) GetCompareSet(p uint, cmp, set byte) bool {
+func (c *chunkMap) GetCompareSet(p uint, cmp, set byte) bool {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	old := c.crumbslice.Get(p)
@@ -234,6 +1004,17 @@ func (c *context) GetCompareSet(p uint, cmp, set byte) bool {
 
 // Errors
 
+// DownloadError is returned when the data at an offset could not be
+// downloaded within the number of attempts allowed by the RetryPolicy.
+type DownloadError struct {
+	Offset int64
+	Err    error
+}
+
+func (d DownloadError) Error() string {
+	return "failed to download data at offset " + strconv.FormatInt(d.Offset, 10) + ": " + d.Err.Error()
+}
+
 type ObjectRemoved struct{}
 
 func (ObjectRemoved) Error() string {
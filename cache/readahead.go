@@ -0,0 +1,102 @@
+package cache
+
+// DefaultReadAhead is the default number of bytes prefetched ahead of a
+// reader that is reading sequentially.
+const DefaultReadAhead = 4 * DefaultChunkSize
+
+// sequentialReads is the number of consecutive reads, each starting where the
+// last finished, after which a reader is considered to be reading
+// sequentially.
+const sequentialReads = 2
+
+// prefetch asks the taskMaster to download the read-ahead window of a reader
+// starting at offset. A negative offset cancels any read-ahead for the
+// reader.
+type prefetch struct {
+	reader uint64
+	offset int64
+}
+
+// readAheader is implemented by objects that can prefetch data for a reader.
+type readAheader interface {
+	readAhead(reader uint64, offset int64)
+	chunk(offset int64) int64
+}
+
+// readAhead sets the position from which data will be prefetched for a
+// reader.
+func (o *object) readAhead(reader uint64, offset int64) {
+	if o.stream != nil || o.opts.readAhead <= 0 && offset >= 0 {
+		return
+	}
+	select {
+	case o.prefetch <- prefetch{reader: reader, offset: offset}:
+	case <-o.quit:
+	}
+}
+
+// chunk returns the chunk containing the given offset.
+func (o *object) chunk(offset int64) int64 {
+	return offset / o.chunkSize
+}
+
+// window returns the number of chunks in the read-ahead window.
+func (o *object) window() uint {
+	if o.opts.readAhead <= o.chunkSize {
+		return 1
+	}
+	return uint((o.opts.readAhead + o.chunkSize - 1) / o.chunkSize)
+}
+
+// moveWindow moves the read-ahead window of a reader, dropping queued
+// downloads for the reader that fall outside of it, cancelling those that
+// are running, and queueing downloads for any chunks in the window that are
+// missing. It returns the change in the number of outstanding downloads.
+func (o *object) moveWindow(cm *chunkMap, p prefetch) int {
+	var start, end uint
+	if p.offset >= 0 && p.offset < o.size && o.opts.readAhead > 0 && !cm.sequential {
+		last := p.offset + o.opts.readAhead
+		if last > o.size {
+			last = o.size
+		}
+		start = uint(o.chunk(p.offset))
+		end = uint(o.chunk(last-1)) + 1
+	}
+	var n int
+	for t := 0; t < len(cm.queue); t++ {
+		if q := cm.queue[t]; q.reader == p.reader && (q.chunk < start || q.chunk >= end) {
+			cm.dequeue(t)
+			cm.Set(q.chunk, 0)
+			n--
+			t--
+		}
+	}
+	for _, d := range cm.downloads {
+		if d.reader == p.reader && !d.cancelled && (d.end <= start || d.next >= end) {
+			d.cancelled = true
+			d.cancel()
+		}
+	}
+	for i := start; i < end; i++ {
+		if cm.Get(i) == 0 && !cm.covered(i, end-start) && cm.GetCompareSet(i, 0, 1) {
+			cm.schedule(queued{
+				chunk:    i,
+				limit:    end,
+				priority: priorityReadAhead,
+				reader:   p.reader,
+			})
+			n++
+		}
+	}
+	o.dispatch(cm)
+	return n
+}
+
+// SetReadAhead sets the number of bytes that are prefetched ahead of a reader
+// that is reading sequentially. A value of zero or less disables read-ahead.
+// The setting applies to objects opened after the call.
+func (c *Cache) SetReadAhead(n int64) {
+	c.mutex.Lock()
+	c.opts.readAhead = n
+	c.mutex.Unlock()
+}
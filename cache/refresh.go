@@ -0,0 +1,38 @@
+package cache
+
+import "github.com/MJKWoolnough/downloader"
+
+// canRefresh determines whether a download error shows that the sources have
+// expired, and that fresh ones can be requested from the Site that the Media
+// came from.
+func (o *object) canRefresh(cm *chunkMap, err error) bool {
+	if cm.refreshing || cm.refreshErr != nil || cm.refreshes >= o.opts.retry.MaxAttempts || !downloader.IsExpired(err) {
+		return false
+	}
+	_, ok := o.origin.(downloader.Refresher)
+	return ok
+}
+
+// refresh starts finding fresh sources, stopping any new downloads until
+// they have been found.
+func (o *object) refresh(cm *chunkMap) {
+	cm.refreshing = true
+	cm.refreshes++
+	go func() {
+		err := o.replaceSources(cm.sources)
+		select {
+		case cm.refreshed <- err:
+		case <-o.quit:
+		}
+	}()
+}
+
+// replaceSources asks the Site that the Media came from to re-resolve it,
+// replacing the sources with those of the result.
+func (o *object) replaceSources(r *sourceSet) error {
+	m, err := o.origin.(downloader.Refresher).Refresh(o.ctx, o.uid)
+	if err != nil {
+		return err
+	}
+	return r.replace(m.Sources, o.size)
+}
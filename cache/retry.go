@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy determines how often, and how quickly, the download of a chunk
+// is retried after a failure.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts made to download a chunk
+	// before the error is returned to readers. A value less than one is
+	// treated as one.
+	MaxAttempts int
+	// MinDelay is the delay before the first retry, doubling for each
+	// subsequent attempt up to MaxDelay.
+	MinDelay, MaxDelay time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay that is
+	// randomised, so that failing downloads do not retry in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is the RetryPolicy used by a new Cache.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	MinDelay:    500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+	Jitter:      0.5,
+}
+
+// delay returns the time to wait before the next attempt, given the number of
+// failed attempts so far.
+func (r RetryPolicy) delay(failures int) time.Duration {
+	d := r.MinDelay
+	for i := 1; i < failures && d < r.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > r.MaxDelay {
+		d = r.MaxDelay
+	}
+	if r.Jitter > 0 {
+		d -= time.Duration(r.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// SetRetryPolicy sets the RetryPolicy used for objects opened after the call.
+func (c *Cache) SetRetryPolicy(r RetryPolicy) {
+	c.mutex.Lock()
+	c.opts.retry = r
+	c.mutex.Unlock()
+}
@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+)
+
+// Download priorities, from highest to lowest.
+const (
+	priorityRequested = iota
+	priorityRetry
+	priorityReadAhead
+	priorityBackground
+)
+
+// downloadSlots limits the number of concurrent downloads across all of the
+// objects in a Cache, both in total and per upstream host. Objects that
+// cannot get a slot wait, and are granted slots in priority order as they
+// are released.
+type downloadSlots struct {
+	mutex   sync.Mutex
+	global  int
+	perHost int
+	running int
+	hosts   map[string]int
+	waiters []*slotWaiter
+	seq     uint64
+}
+
+// slotWaiter represents an object waiting for a download slot.
+type slotWaiter struct {
+	priority int
+	seq      uint64
+	hosts    []string
+	waiting  bool
+	granted  []string
+	signal   chan struct{}
+}
+
+func newSlotWaiter() *slotWaiter {
+	return &slotWaiter{
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func newDownloadSlots() *downloadSlots {
+	return &downloadSlots{
+		hosts: make(map[string]int),
+	}
+}
+
+// setLimits changes the limits, granting slots to waiters if they have been
+// raised. A limit of zero or less means unlimited.
+func (d *downloadSlots) setLimits(perHost, global int) {
+	d.mutex.Lock()
+	d.perHost = perHost
+	d.global = global
+	d.grant()
+	d.mutex.Unlock()
+}
+
+func (d *downloadSlots) available(host string) bool {
+	return (d.global <= 0 || d.running < d.global) && (d.perHost <= 0 || host == "" || d.hosts[host] < d.perHost)
+}
+
+func (d *downloadSlots) take(host string) {
+	d.running++
+	if host != "" {
+		d.hosts[host]++
+	}
+}
+
+// acquire takes a slot for the first of the hosts that has one available.
+// If none are available, the waiter is queued with the given priority and
+// will be signalled when a slot has been granted to it.
+func (d *downloadSlots) acquire(w *slotWaiter, hosts []string, priority int) (string, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, host := range hosts {
+		if d.available(host) {
+			d.take(host)
+			if w.waiting {
+				d.remove(w)
+			}
+			return host, true
+		}
+	}
+	w.hosts = hosts
+	if !w.waiting || w.priority != priority {
+		if w.waiting {
+			d.remove(w)
+		}
+		w.priority = priority
+		w.seq = d.seq
+		d.seq++
+		w.waiting = true
+		d.waiters = append(d.waiters, w)
+		sort.Sort(waiterList(d.waiters))
+	}
+	return "", false
+}
+
+// release frees a slot for the host, granting it to the highest priority
+// waiter that can use it.
+func (d *downloadSlots) release(host string) {
+	d.mutex.Lock()
+	d.running--
+	if host != "" {
+		if d.hosts[host]--; d.hosts[host] == 0 {
+			delete(d.hosts, host)
+		}
+	}
+	d.grant()
+	d.mutex.Unlock()
+}
+
+// grant hands out available slots to waiters. The mutex must be held when
+// calling.
+func (d *downloadSlots) grant() {
+	for i := 0; i < len(d.waiters); i++ {
+		w := d.waiters[i]
+		for _, host := range w.hosts {
+			if d.available(host) {
+				d.take(host)
+				w.granted = append(w.granted, host)
+				d.remove(w)
+				i--
+				select {
+				case w.signal <- struct{}{}:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
+
+func (d *downloadSlots) remove(w *slotWaiter) {
+	for i, v := range d.waiters {
+		if v == w {
+			d.waiters = append(d.waiters[:i], d.waiters[i+1:]...)
+			break
+		}
+	}
+	w.waiting = false
+}
+
+// granted returns the hosts for which slots have been granted to the waiter.
+func (d *downloadSlots) granted(w *slotWaiter) []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	g := w.granted
+	w.granted = nil
+	return g
+}
+
+// cancel removes the waiter from the queue, releasing any slots granted to
+// it.
+func (d *downloadSlots) cancel(w *slotWaiter) {
+	d.mutex.Lock()
+	if w.waiting {
+		d.remove(w)
+	}
+	g := w.granted
+	w.granted = nil
+	d.mutex.Unlock()
+	for _, host := range g {
+		d.release(host)
+	}
+}
+
+type waiterList []*slotWaiter
+
+func (w waiterList) Len() int {
+	return len(w)
+}
+
+func (w waiterList) Less(i, j int) bool {
+	if w[i].priority == w[j].priority {
+		return w[i].seq < w[j].seq
+	}
+	return w[i].priority < w[j].priority
+}
+
+func (w waiterList) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+}
+
+// SetDownloadLimits sets the maximum number of concurrent downloads for each
+// object, for each upstream host, and for the whole Cache. A limit of zero or
+// less means unlimited. The per-object limit applies to objects opened after
+// the call, while the others take effect immediately.
+func (c *Cache) SetDownloadLimits(perObject, perHost, global int) {
+	c.mutex.Lock()
+	c.opts.maxDownloads = perObject
+	c.mutex.Unlock()
+	c.opts.slots.setLimits(perHost, global)
+}
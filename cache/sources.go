@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+// maxSourceFailures is the number of consecutive failures after which a
+// source is considered unhealthy.
+const maxSourceFailures = 3
+
+type source struct {
+	downloader.Downloader
+	host             string
+	active, failures int
+	// rate is the measured throughput of the source, in bytes per second.
+	rate float64
+}
+
+func (s *source) healthy() bool {
+	return s.failures < maxSourceFailures
+}
+
+// sourceSet balances downloads across the equivalent sources of a Media,
+// preferring healthy sources with the fewest active downloads.
+type sourceSet struct {
+	mutex   sync.Mutex
+	sources []*source
+}
+
+// newSourceSet creates a sourceSet from those downloaders whose length
+// matches the given size.
+func newSourceSet(ds []downloader.Downloader, size int64) (*sourceSet, error) {
+	s := &sourceSet{sources: make([]*source, 0, len(ds))}
+	for _, d := range ds {
+		if d.Length() == size {
+			src := &source{Downloader: d}
+			if h, ok := d.(interface {
+				Host() string
+			}); ok {
+				src.host = h.Host()
+			}
+			s.sources = append(s.sources, src)
+		}
+	}
+	if len(s.sources) == 0 {
+		return nil, LengthMismatch{}
+	}
+	return s, nil
+}
+
+// replace swaps the sources for a new set, after the old ones have expired.
+// Downloads already running from the old sources are unaffected.
+func (s *sourceSet) replace(ds []downloader.Downloader, size int64) error {
+	n, err := newSourceSet(ds, size)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.sources = n.sources
+	s.mutex.Unlock()
+	return nil
+}
+
+// ordered returns the sources from best to worst for a new download. When
+// all sources are unhealthy, the ones with the fewest failures are first, so
+// that the RetryPolicy alone decides when to give up.
+func (s *sourceSet) ordered() []*source {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ordered := make([]*source, len(s.sources))
+	copy(ordered, s.sources)
+	sort.Stable(sourceList(ordered))
+	return ordered
+}
+
+// hosts returns the hosts of the sources, from best to worst.
+func (s *sourceSet) hosts() []string {
+	ordered := s.ordered()
+	hosts := make([]string, len(ordered))
+	for n, src := range ordered {
+		hosts[n] = src.host
+	}
+	return hosts
+}
+
+// get returns the best source for the given host, marking it as active.
+func (s *sourceSet) get(host string) *source {
+	for _, src := range s.ordered() {
+		if src.host == host {
+			s.mutex.Lock()
+			src.active++
+			s.mutex.Unlock()
+			return src
+		}
+	}
+	return nil
+}
+
+type sourceList []*source
+
+func (s sourceList) Len() int {
+	return len(s)
+}
+
+func (s sourceList) Less(i, j int) bool {
+	return better(s[i], s[j])
+}
+
+func (s sourceList) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func better(a, b *source) bool {
+	if ah, bh := a.healthy(), b.healthy(); ah != bh {
+		return ah
+	} else if !ah || a.active == b.active {
+		return a.failures < b.failures
+	}
+	return a.active < b.active
+}
+
+// done records the result of a download from the source.
+func (s *sourceSet) done(src *source, err error) {
+	s.mutex.Lock()
+	src.active--
+	if err != nil {
+		src.failures++
+	} else {
+		src.failures = 0
+	}
+	s.mutex.Unlock()
+}
+
+// sequential determines whether all of the sources can only be read from the
+// start.
+func (s *sourceSet) sequential() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, src := range s.sources {
+		if sd, ok := src.Downloader.(downloader.SequentialDownloader); !ok || !sd.Sequential() {
+			return false
+		}
+	}
+	return true
+}
+
+// measure records the throughput of a download from the source.
+func (s *sourceSet) measure(src *source, n int64, d time.Duration) {
+	if n <= 0 || d <= 0 {
+		return
+	}
+	rate := float64(n) / d.Seconds()
+	s.mutex.Lock()
+	if src.rate == 0 {
+		src.rate = rate
+	} else {
+		src.rate = (src.rate + rate) / 2
+	}
+	s.mutex.Unlock()
+}
+
+// throughput returns the measured throughput of the source, in bytes per
+// second, or zero if it has yet to be measured.
+func (s *sourceSet) throughput(src *source) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return src.rate
+}
+
+// cancelled records that a download from the source was cancelled, which
+// counts as neither a success nor a failure.
+func (s *sourceSet) cancelled(src *source) {
+	s.mutex.Lock()
+	src.active--
+	s.mutex.Unlock()
+}
+
+// Errors
+
+// LengthMismatch is an error returned when none of the sources of a Media
+// have the expected length.
+type LengthMismatch struct{}
+
+func (LengthMismatch) Error() string {
+	return "no source matches the media length"
+}
@@ -0,0 +1,260 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+// stream tracks the progress of an object of unknown length, which is
+// downloaded linearly, growing as data arrives.
+type stream struct {
+	mutex   sync.Mutex
+	written int64
+	done    bool
+	err     error
+	grown   chan struct{}
+}
+
+func newStream() *stream {
+	return &stream{
+		grown: make(chan struct{}),
+	}
+}
+
+// grow records that more data has been written, waking any waiting readers.
+func (s *stream) grow(n int64) {
+	s.mutex.Lock()
+	s.written += n
+	close(s.grown)
+	s.grown = make(chan struct{})
+	s.mutex.Unlock()
+}
+
+// finish records that the stream has ended, either successfully or with an
+// error, waking any waiting readers.
+func (s *stream) finish(err error) {
+	s.mutex.Lock()
+	if err == nil {
+		s.done = true
+	} else {
+		s.err = err
+	}
+	close(s.grown)
+	s.grown = make(chan struct{})
+	s.mutex.Unlock()
+}
+
+// size returns the length of the stream, or downloader.UnknownLength if it
+// has yet to end.
+func (s *stream) size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done {
+		return s.written
+	}
+	return downloader.UnknownLength
+}
+
+// progress returns the number of bytes written so far.
+func (s *stream) progress() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.written
+}
+
+// wait blocks until the stream has been written up to end, or has ended.
+func (s *stream) wait(ctx context.Context, quit chan struct{}, end int64) error {
+	for {
+		s.mutex.Lock()
+		written, done, err, grown := s.written, s.done, s.err, s.grown
+		s.mutex.Unlock()
+		if written >= end || done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		select {
+		case <-grown:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-quit:
+			return ObjectRemoved{}
+		}
+	}
+}
+
+// streamer downloads an object of unknown length from start to finish,
+// resuming from where it stopped when a download fails. Once complete, the
+// index is rewritten with the final size so that the object can be reused
+// like any other.
+func (o *object) streamer(r *sourceSet) {
+	go func() {
+		<-o.quit
+		o.cancel()
+	}()
+	var (
+		sums      []uint32
+		crc       = crc32.New(crcTable)
+		fill      int64
+		digest    hash.Hash
+		failures  int
+		refreshes int
+		buf       = make([]byte, 32*1024)
+	)
+	if o.digest.Sum != nil {
+		digest = o.digest.NewHash()
+	}
+	o.index.setFlag(flagDirty, true)
+	for {
+		src, ok := o.streamSource(r)
+		if !ok {
+			break
+		}
+		written := o.stream.progress()
+		from := written
+		if sd, ok := src.Downloader.(downloader.SequentialDownloader); ok && sd.Sequential() {
+			from = 0
+		}
+		rc, err := downloader.NewReadCloserContext(o.ctx, src, from, downloader.UnknownLength)
+		if err == nil && from < written {
+			_, err = io.CopyN(ioutil.Discard, rc, written-from)
+		}
+		for err == nil {
+			var n int
+			n, err = rc.Read(buf)
+			if n > 0 {
+				if _, werr := o.file.WriteAt(buf[:n], written); werr != nil {
+					err = werr
+					break
+				}
+				written += int64(n)
+				if digest != nil {
+					digest.Write(buf[:n])
+				}
+				for data := buf[:n]; len(data) > 0; {
+					l := o.chunkSize - fill
+					if int64(len(data)) < l {
+						l = int64(len(data))
+					}
+					crc.Write(data[:l])
+					data = data[l:]
+					if fill += l; fill == o.chunkSize {
+						sums = append(sums, crc.Sum32())
+						crc.Reset()
+						fill = 0
+					}
+				}
+				o.stream.grow(int64(n))
+				failures = 0
+				refreshes = 0
+			}
+		}
+		if rc != nil {
+			rc.Close()
+		}
+		o.opts.slots.release(src.host)
+		if err == io.EOF {
+			r.done(src, nil)
+			if fill > 0 {
+				sums = append(sums, crc.Sum32())
+			}
+			if digest != nil && !bytes.Equal(digest.Sum(nil), o.digest.Sum) {
+				o.stream.finish(downloader.DigestMismatch{})
+			} else if err = o.complete(written, sums, digest != nil); err != nil {
+				o.stream.finish(err)
+			} else {
+				o.stream.finish(nil)
+			}
+			break
+		}
+		r.done(src, err)
+		if _, ok := err.(downloader.ResourceChanged); ok {
+			o.stream.finish(err)
+			break
+		}
+		if _, ok := o.origin.(downloader.Refresher); ok && downloader.IsExpired(err) && refreshes < o.opts.retry.MaxAttempts {
+			refreshes++
+			if o.replaceSources(r) == nil {
+				continue
+			}
+		}
+		if failures++; failures >= o.opts.retry.MaxAttempts || o.ctx.Err() != nil {
+			o.stream.finish(DownloadError{
+				Offset: written,
+				Err:    err,
+			})
+			break
+		}
+		t := time.NewTimer(o.opts.retry.delay(failures))
+		select {
+		case <-t.C:
+		case <-o.quit:
+			t.Stop()
+		}
+	}
+	<-o.quit
+	o.close()
+}
+
+// streamSource waits for a download slot, returning the best source for it,
+// or false if the object is closed while waiting.
+func (o *object) streamSource(r *sourceSet) (*source, bool) {
+	w := newSlotWaiter()
+	host, ok := o.opts.slots.acquire(w, r.hosts(), priorityRequested)
+	for !ok {
+		select {
+		case <-w.signal:
+			granted := o.opts.slots.granted(w)
+			if len(granted) == 0 {
+				continue
+			}
+			host, ok = granted[0], true
+			for _, h := range granted[1:] {
+				o.opts.slots.release(h)
+			}
+		case <-o.quit:
+			o.opts.slots.cancel(w)
+			return nil, false
+		}
+	}
+	return r.get(host), true
+}
+
+// complete replaces the index of a finished stream with one recording its
+// final size, and the checksum of each chunk. The mutex is held while the
+// index is swapped, as readers record their accesses in it.
+func (o *object) complete(size int64, sums []uint32, verified bool) error {
+	o.mutex.Lock()
+	filename := o.index.file.Name()
+	m := downloader.Media{
+		LastModified: o.index.lastModified,
+		MimeType:     o.index.mimeType,
+	}
+	o.index.Close()
+	i, err := createIndex(filename, o.index.key, m, size, o.chunkSize)
+	if err == nil {
+		o.index = i
+		o.saveAccess()
+	}
+	o.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for n, sum := range sums {
+		if err = i.setDone(uint(n), sum); err != nil {
+			return err
+		}
+	}
+	if err = i.setFlag(flagDirty, true); err != nil {
+		return err
+	}
+	return i.setFlag(flagVerified, verified)
+}
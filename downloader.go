@@ -1,7 +1,18 @@
 package downloader
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
 	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,6 +25,31 @@ type Site interface {
 	Request(string) (*Request, error)
 }
 
+// ContextSite is a Site that can have its requests cancelled.
+type ContextSite interface {
+	Site
+	// RequestContext acts like Request, but stops when the context is
+	// cancelled.
+	RequestContext(context.Context, string) (*Request, error)
+}
+
+// ConfirmSite is a Site whose Match is a quick check, such as a regular
+// expression, which may give false positives. Before its Request is made,
+// the match is confirmed by Confirm, which may use the network. Confirm
+// returns false when the url isn't one that the Site handles, and an error
+// when that couldn't be determined.
+type ConfirmSite interface {
+	Site
+	Confirm(ctx context.Context, url string) (bool, error)
+}
+
+// Refresher is implemented by Sites whose Sources expire, such as those with
+// signed URLs. Refresh re-resolves the Media with the given UID into one with
+// fresh Sources.
+type Refresher interface {
+	Refresh(ctx context.Context, uid string) (Media, error)
+}
+
 // Request is a value returned by a downloader and contains all of the
 // necessary information to download a particular file.
 type Request struct {
@@ -22,6 +58,37 @@ type Request struct {
 	// Downloaders a a list of ReadClosers that all represented the requested
 	// media.
 	Downloaders []Media
+	// Metadata describes the requested item.
+	Metadata Metadata
+}
+
+// Metadata describes the item that a Request is for. Any field may be empty
+// when the Site doesn't know it.
+type Metadata struct {
+	Title string
+	// Author is the uploader, or the channel, of the item.
+	Author      string
+	Description string
+	UploadDate  time.Time
+	Tags        []string
+	// Thumbnails are images of the item, which can be downloaded like any
+	// other Media.
+	Thumbnails []Media
+	// URL is the canonical URL of the item.
+	URL string
+	// Site is the name of the Site that made the Request, which is set by
+	// DoRequest.
+	Site string
+}
+
+// MediaFilename returns the Filename of the Request with the extension
+// replaced by that of the given Media.
+func (r *Request) MediaFilename(m Media) string {
+	ext := m.Extension()
+	if ext == "" {
+		return r.Filename
+	}
+	return strings.TrimSuffix(r.Filename, path.Ext(r.Filename)) + ext
 }
 
 type Downloader interface {
@@ -29,6 +96,91 @@ type Downloader interface {
 	Length() int64
 }
 
+// UnknownLength is returned by Downloader.Length when the length of the data
+// cannot be determined in advance, such as for a live or chunk-encoded
+// stream. A negative length passed to NewReadCloser reads to the end of the
+// data.
+const UnknownLength = -1
+
+// ContextDownloader is a Downloader whose ReadClosers can be bound to a
+// context, stopping the download when the context is cancelled.
+type ContextDownloader interface {
+	Downloader
+	NewReadCloserContext(ctx context.Context, start int64, length int64) (io.ReadCloser, error)
+}
+
+// SequentialDownloader is implemented by Downloaders that may only be able to
+// read their data from the start, such as those for servers that don't
+// support range requests. Sequential returns true once that is known, in
+// which case reads that don't start at the beginning may be slow, or fail.
+type SequentialDownloader interface {
+	Downloader
+	Sequential() bool
+}
+
+// NewReadCloserContext creates a ReadCloser from the Downloader that is
+// closed when the context is cancelled. If the Downloader is a
+// ContextDownloader then its NewReadCloserContext method is used.
+func NewReadCloserContext(ctx context.Context, d Downloader, start, length int64) (io.ReadCloser, error) {
+	if cd, ok := d.(ContextDownloader); ok {
+		return cd.NewReadCloserContext(ctx, start, length)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rc, err := d.NewReadCloser(start, length)
+	if err != nil {
+		return nil, err
+	}
+	c := &contextReadCloser{
+		ReadCloser: rc,
+		ctx:        ctx,
+		closed:     make(chan struct{}),
+	}
+	go c.wait()
+	return c, nil
+}
+
+type contextReadCloser struct {
+	io.ReadCloser
+	ctx    context.Context
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *contextReadCloser) wait() {
+	select {
+	case <-c.ctx.Done():
+		c.once.Do(func() {
+			c.ReadCloser.Close()
+		})
+	case <-c.closed:
+	}
+}
+
+func (c *contextReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		if cerr := c.ctx.Err(); cerr != nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
+
+func (c *contextReadCloser) Verifying() bool {
+	return IsVerifying(c.ReadCloser)
+}
+
+func (c *contextReadCloser) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.ReadCloser.Close()
+	})
+	return err
+}
+
 // Media contains information about a particular version of a file.
 type Media struct {
 	// Size is the length, in bytes, of the requested media.
@@ -39,32 +191,198 @@ type Media struct {
 	// versions of the media (different qualities, mimetypes, etc.) should
 	// have a different UID.
 	UID string
-	// LastModified is the last modified time of the media. Set to time.Now()
-	// when undeterminable.
+	// LastModified is the last modified time of the media. Left as the zero
+	// time when undeterminable.
 	LastModified time.Time
 	// Sources represents a list of possible sources for this incarnation
 	// of the media file
 	Sources []Downloader
+	// Digest, if known, is a checksum of the complete media.
+	Digest Digest
+	// Width and Height are the dimensions, in pixels, of any video, or zero
+	// if unknown.
+	Width, Height int
+	// Bitrate is the average bitrate, in bits per second, of the media, or
+	// zero if unknown.
+	Bitrate int
+	// VideoCodec and AudioCodec name the codecs of the streams in the
+	// media, as in the codecs parameter of a mime type, e.g. "avc1.4d401e"
+	// or "mp4a.40.2". They are empty if unknown, or there is no such
+	// stream.
+	VideoCodec, AudioCodec string
+	// VideoBitrate and AudioBitrate are the bitrates, in bits per second,
+	// of the individual streams, or zero if unknown.
+	VideoBitrate, AudioBitrate int
+	// Duration is the play time of the media, or zero if unknown.
+	Duration time.Duration
+	// AudioLanguage is the language of any audio, as a BCP 47 tag such as
+	// "en" or "pt-BR", or empty if unknown.
+	AudioLanguage string
+	// Container names the container format, such as "mp4", "webm" or
+	// "3gp", or is empty if unknown.
+	Container string
+	// Origin is the Site that the Media came from, which is set by
+	// DoRequest. If it implements Refresher, it is used to replace Sources
+	// that have expired.
+	Origin Site
 }
 
-var sites []Site
+// extensions are the preferred extensions for common mime types, for which
+// the mime package may give a less common one.
+var extensions = map[string]string{
+	"video/mp4":   ".mp4",
+	"video/webm":  ".webm",
+	"video/3gpp":  ".3gp",
+	"video/x-flv": ".flv",
+	"audio/mp4":   ".m4a",
+	"audio/mpeg":  ".mp3",
+	"audio/webm":  ".weba",
+	"audio/ogg":   ".ogg",
+	"image/jpeg":  ".jpg",
+	"image/png":   ".png",
+	"image/webp":  ".webp",
+	"text/plain":  ".txt",
+}
 
-// Register allows packages to register a Site.
+// Extension returns the file extension, including the leading dot, for the
+// Media, as determined by its Container or, failing that, its MimeType. An
+// empty string is returned if neither is known.
+func (m Media) Extension() string {
+	if m.Container != "" {
+		return "." + m.Container
+	}
+	mt, _, err := mime.ParseMediaType(m.MimeType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := extensions[mt]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mt); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// Digest is a checksum of some data, used to verify a download.
+type Digest struct {
+	// Algorithm is the name of the hash algorithm as registered for the HTTP
+	// Digest header, e.g. "md5", "sha", "sha-256" or "sha-512".
+	Algorithm string
+	Sum       []byte
+}
+
+// NewHash returns a new hash.Hash for the digest algorithm, or nil if the
+// algorithm is unknown.
+func (d Digest) NewHash() hash.Hash {
+	switch strings.ToLower(d.Algorithm) {
+	case "md5":
+		return md5.New()
+	case "sha", "sha-1":
+		return sha1.New()
+	case "sha-256":
+		return sha256.New()
+	case "sha-512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// Register allows packages to register a Site with the DefaultRegistry. The
+// Site is named after its type.
 func Register(s Site) {
-	sites = append(sites, s)
+	DefaultRegistry.Register(typeName(s), s, PriorityDefault)
+}
+
+// RegisterFallback registers a Site with the DefaultRegistry that is only
+// tried when no other Site matches, such as one that matches any URL.
+func RegisterFallback(s Site) {
+	DefaultRegistry.Register(typeName(s), s, PriorityFallback)
 }
 
+// DoRequest finds a Site in the DefaultRegistry to handle the url.
 func DoRequest(url string) (*Request, error) {
-	for _, site := range sites {
-		if site.Match(url) {
-			return site.Request(url)
-		}
-	}
-	return nil, NoRequest{}
+	return DefaultRegistry.DoRequest(url)
+}
+
+// DoRequestContext acts like DoRequest, but passes the context to any Site
+// that implements ContextSite.
+func DoRequestContext(ctx context.Context, url string) (*Request, error) {
+	return DefaultRegistry.DoRequestContext(ctx, url)
+}
+
+// IsExpired determines whether an error returned by a Downloader shows that
+// its source has expired, such as a signed URL that is no longer valid, by the
+// error having an Expired method that returns true.
+func IsExpired(err error) bool {
+	e, ok := err.(interface {
+		Expired() bool
+	})
+	return ok && e.Expired()
+}
+
+// IsVerifying determines whether a ReadCloser returned by a Downloader checks
+// the data it reads against a digest, returning a DigestMismatch error
+// instead of io.EOF when they differ, by it having a Verifying method that
+// returns true.
+func IsVerifying(r io.Reader) bool {
+	v, ok := r.(interface {
+		Verifying() bool
+	})
+	return ok && v.Verifying()
+}
+
+// IsNotMine determines whether an error returned by a Site shows that the url
+// isn't one that it handles after all, by the error having a NotMine method
+// that returns true.
+func IsNotMine(err error) bool {
+	e, ok := err.(interface {
+		NotMine() bool
+	})
+	return ok && e.NotMine()
 }
 
 // Errors
 
+// DigestMismatch is an error returned when downloaded data does not match its
+// Digest.
+type DigestMismatch struct{}
+
+func (DigestMismatch) Error() string {
+	return "downloaded data does not match digest"
+}
+
+// ResourceChanged is an error returned by a Downloader when the data has
+// changed since its length was determined, so that data already downloaded
+// can't be combined with any more.
+type ResourceChanged struct{}
+
+func (ResourceChanged) Error() string {
+	return "resource changed during download"
+}
+
+// NotMine is an error that a Site can return from Request when, despite
+// matching, the url isn't one that it handles, so that the next matching
+// Site is tried.
+type NotMine struct{}
+
+func (NotMine) Error() string {
+	return "url not handled by site"
+}
+
+// NotMine returns true.
+func (NotMine) NotMine() bool {
+	return true
+}
+
+// BadSelector is an error returned when a term of a selector expression
+// cannot be parsed.
+type BadSelector string
+
+func (b BadSelector) Error() string {
+	return "invalid selector term: " + strconv.Quote(string(b))
+}
+
 type NoRequest struct{}
 
 func (NoRequest) Error() string {
@@ -0,0 +1,22 @@
+package downloader
+
+import "testing"
+
+func TestMediaFilename(t *testing.T) {
+	r := &Request{Filename: "A Video.mp4"}
+	for n, test := range [...]struct {
+		media    Media
+		filename string
+	}{
+		{Media{MimeType: "video/mp4"}, "A Video.mp4"},
+		{Media{MimeType: "video/webm; codecs=\"vp9\""}, "A Video.webm"},
+		{Media{MimeType: "video/mp4", Container: "mkv"}, "A Video.mkv"},
+		{Media{MimeType: "video/3gpp"}, "A Video.3gp"},
+		{Media{MimeType: "audio/mp4"}, "A Video.m4a"},
+		{Media{}, "A Video.mp4"},
+	} {
+		if f := r.MediaFilename(test.media); f != test.filename {
+			t.Errorf("test %d: expecting %q, got %q", n+1, test.filename, f)
+		}
+	}
+}
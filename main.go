@@ -4,27 +4,56 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/MJKWoolnough/downloader"
 
 	"github.com/MJKWoolnough/downloader/cache"
+	phttp "github.com/MJKWoolnough/downloader/protocols/http"
+	_ "github.com/MJKWoolnough/downloader/sites/direct"
 	_ "github.com/MJKWoolnough/downloader/sites/youtube"
+	"github.com/MJKWoolnough/downloader/throttle"
 )
 
-var fileCache *cache.Cache
+var (
+	fileCache *cache.Cache
+	throttler = throttle.New()
+)
 
 func main() {
-	fileCache = cache.NewCache("/home/michael/temp/dlcache/")
+	var err error
+	fileCache, err = cache.NewCache("/home/michael/temp/dlcache/")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// Only the machines named in the netrc file are given credentials, so
+	// that proxied requests to other hosts can't obtain them.
+	if n, err := phttp.LoadNetrc(""); err == nil {
+		phttp.DefaultHosts.SetNetrc(n)
+	}
 	http.ListenAndServe(":8080", http.HandlerFunc(proxy))
 }
 
 func proxy(w http.ResponseWriter, r *http.Request) {
+	// The URL is either the whole of the path and query, or, to allow a
+	// selector, given as the url parameter.
 	url := r.RequestURI
 	if url[0] == '/' {
 		url = url[1:]
 	}
-	req, err := downloader.DoRequest(url)
+	var sel downloader.Selector
+	if q := r.URL.Query(); r.URL.Path == "/" && q.Get("url") != "" {
+		url = q.Get("url")
+		var err error
+		if sel, err = downloader.ParseSelector(q.Get("select")); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	req, err := downloader.DoRequestContext(r.Context(), url)
 	if err != nil {
 		if _, ok := err.(downloader.NoRequest); ok {
 			w.WriteHeader(http.StatusNotFound)
@@ -34,14 +63,30 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 		return
 	}
-	d := req.Downloaders[0]
+	m, ok := sel.Best(req)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	d := throttler.WrapMedia(req.Metadata.Site, m)
 
-	c, err := fileCache.Get(d.UID, d.Sources[0])
+	c, err := fileCache.GetContext(r.Context(), d)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	w.Header().Add("Content-Disposition", fmt.Sprintf("inline; filename=%q", req.Filename))
-	http.ServeContent(w, r, req.Filename, d.LastModified, c)
+	defer c.Close()
+	filename := req.MediaFilename(m)
+	w.Header().Add("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	if c.Size() < 0 {
+		// A stream of unknown length can't be seeked, so it is sent
+		// as it arrives.
+		if d.MimeType != "" {
+			w.Header().Set("Content-Type", d.MimeType)
+		}
+		io.Copy(w, c)
+		return
+	}
+	http.ServeContent(w, r, filename, d.LastModified, c)
 }
@@ -0,0 +1,62 @@
+// Package file implements a downloader.Downloader for local files, including
+// those on network mounts.
+package file
+
+import (
+	"io"
+	"os"
+)
+
+// File turns a local file into a io.ReadCloser.
+type File struct {
+	Path string
+	Size int64
+}
+
+// NewFile creates a File for the given path, determining its length.
+func NewFile(path string) (*File, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, IsDir(path)
+	}
+	return &File{
+		Path: path,
+		Size: fi.Size(),
+	}, nil
+}
+
+// NewReadCloser returns a new io.ReadCloser with the start and end bounds set.
+// A negative length reads to the end of the file. Each ReadCloser has its own
+// handle on the file, and reads it with ReadAt.
+func (f *File) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	fh, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || start+length > f.Size {
+		length = f.Size - start
+	}
+	return readCloser{io.NewSectionReader(fh, start, length), fh}, nil
+}
+
+// Length returns the length of the file.
+func (f *File) Length() int64 {
+	return f.Size
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Errors
+
+// IsDir is an error returned when the path is a directory.
+type IsDir string
+
+func (i IsDir) Error() string {
+	return "path is a directory: " + string(i)
+}
@@ -0,0 +1,52 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	data := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	path := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = NewFile(dir); err == nil {
+		t.Error("expecting error for directory")
+	}
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l := f.Length(); l != int64(len(data)) {
+		t.Fatalf("expecting length %d, got %d", len(data), l)
+	}
+	for n, test := range [...]struct {
+		start, length int64
+		expected      string
+	}{
+		{0, -1, data},
+		{10, 20, data[10:30]},
+		{50, -1, data[50:]},
+		{55, 100, data[55:]},
+	} {
+		r, err := f.NewReadCloser(test.start, test.length)
+		if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			continue
+		}
+		if got, err := ioutil.ReadAll(r); err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+		} else if string(got) != test.expected {
+			t.Errorf("test %d: expecting %q, got %q", n+1, test.expected, got)
+		}
+		r.Close()
+	}
+}
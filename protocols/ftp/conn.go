@@ -0,0 +1,151 @@
+package ftp
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// conn is a control connection to an FTP server.
+type conn struct {
+	*textproto.Conn
+	host string
+	stop chan struct{}
+
+	mutex sync.Mutex
+	data  net.Conn
+}
+
+// connect dials the server and logs in, switching to binary mode. The
+// connection is closed if the context is cancelled before close is called.
+func (f *FTP) connect(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: f.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", f.Addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(nc.RemoteAddr().String())
+	c := &conn{
+		Conn: textproto.NewConn(nc),
+		host: host,
+		stop: make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mutex.Lock()
+			if c.data != nil {
+				c.data.Close()
+			}
+			c.mutex.Unlock()
+			c.Conn.Close()
+		case <-c.stop:
+		}
+	}()
+	if _, _, err = c.ReadResponse(220); err != nil {
+		c.close()
+		return nil, err
+	}
+	user, password := f.User, f.Password
+	if user == "" {
+		user, password = "anonymous", "anonymous@"
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", password)
+	}
+	if err == nil && code != 230 && code != 202 {
+		err = &textproto.Error{Code: code, Msg: "login failed"}
+	}
+	if err == nil {
+		_, _, err = c.cmd(200, "TYPE I")
+	}
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command and reads the reply, which must have a code beginning
+// with the digits of expectCode. An expectCode of 0 accepts any successful
+// reply.
+func (c *conn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.ReadResponse(expectCode)
+	if expectCode == 0 && err == nil && code >= 400 {
+		err = &textproto.Error{Code: code, Msg: msg}
+	}
+	return code, msg, err
+}
+
+// passive opens a data connection, trying extended passive mode first. The
+// address given by the server is ignored in favour of the host of the
+// control connection, which also works from behind NAT.
+func (c *conn) passive(ctx context.Context) (net.Conn, error) {
+	var port int
+	if _, msg, err := c.cmd(229, "EPSV"); err == nil {
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start+4 {
+			return nil, BadReply(msg)
+		}
+		if port, err = strconv.Atoi(msg[start+4 : end]); err != nil {
+			return nil, BadReply(msg)
+		}
+	} else if _, ok := err.(*textproto.Error); !ok {
+		return nil, err
+	} else if _, msg, err = c.cmd(227, "PASV"); err != nil {
+		return nil, err
+	} else {
+		start, end := strings.IndexByte(msg, '('), strings.LastIndexByte(msg, ')')
+		if start < 0 || end < start {
+			return nil, BadReply(msg)
+		}
+		fields := strings.Split(msg[start+1:end], ",")
+		if len(fields) != 6 {
+			return nil, BadReply(msg)
+		}
+		p1, err1 := strconv.Atoi(fields[4])
+		p2, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil {
+			return nil, BadReply(msg)
+		}
+		port = p1<<8 | p2
+	}
+	var d net.Dialer
+	data, err := d.DialContext(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.data = data
+	c.mutex.Unlock()
+	return data, nil
+}
+
+// quit logs out and closes the connection.
+func (c *conn) quit() {
+	c.cmd(221, "QUIT")
+	c.close()
+}
+
+// close closes the connection without logging out, and any data connection,
+// which aborts a transfer in progress.
+func (c *conn) close() {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	c.mutex.Lock()
+	if c.data != nil {
+		c.data.Close()
+	}
+	c.mutex.Unlock()
+	c.Conn.Close()
+}
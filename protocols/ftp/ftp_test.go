@@ -0,0 +1,203 @@
+package ftp
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type server struct {
+	net.Listener
+	data           string
+	noEPSV, noRest bool
+	wg             sync.WaitGroup
+}
+
+func newServer(t *testing.T, data string) *server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &server{Listener: l, data: data}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *server) Close() {
+	s.Listener.Close()
+	s.wg.Wait()
+}
+
+func (s *server) serve(c net.Conn) {
+	defer s.wg.Done()
+	defer c.Close()
+	var (
+		r      = bufio.NewReader(c)
+		data   net.Listener
+		offset int
+	)
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	reply := func(code int, msg string) {
+		c.Write([]byte(strconv.Itoa(code) + " " + msg + "\r\n"))
+	}
+	reply(220, "ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		var arg string
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		switch fields[0] {
+		case "USER":
+			if arg == "anonymous" {
+				reply(230, "logged in")
+			} else {
+				reply(331, "password required")
+			}
+		case "PASS":
+			if arg == "secret" {
+				reply(230, "logged in")
+			} else {
+				reply(530, "login incorrect")
+			}
+		case "TYPE":
+			reply(200, "binary")
+		case "SIZE":
+			if arg == "/file" {
+				reply(213, strconv.Itoa(len(s.data)))
+			} else {
+				reply(550, "not found")
+			}
+		case "EPSV", "PASV":
+			if s.noEPSV && fields[0] == "EPSV" {
+				reply(500, "unknown command")
+				continue
+			}
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply(425, "no data connection")
+				continue
+			}
+			port := data.Addr().(*net.TCPAddr).Port
+			if fields[0] == "EPSV" {
+				reply(229, "Entering Extended Passive Mode (|||"+strconv.Itoa(port)+"|)")
+			} else {
+				reply(227, "Entering Passive Mode (127,0,0,1,"+strconv.Itoa(port>>8)+","+strconv.Itoa(port&255)+")")
+			}
+		case "REST":
+			if s.noRest {
+				reply(502, "not implemented")
+			} else {
+				offset, _ = strconv.Atoi(arg)
+				reply(350, "restarting")
+			}
+		case "RETR":
+			if data == nil {
+				reply(425, "no data connection")
+				continue
+			}
+			reply(150, "opening data connection")
+			dc, err := data.Accept()
+			data.Close()
+			data = nil
+			if err != nil {
+				return
+			}
+			dc.Write([]byte(s.data[offset:]))
+			dc.Close()
+			offset = 0
+			reply(226, "transfer complete")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "not implemented")
+		}
+	}
+}
+
+func TestFTP(t *testing.T) {
+	data := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	for n, test := range [...]struct {
+		url            string
+		noEPSV, noRest bool
+	}{
+		{"ftp://%s/file", false, false},
+		{"ftp://user:secret@%s/file", false, false},
+		{"ftp://%s/file", true, false},
+		{"ftp://%s/file", false, true},
+	} {
+		s := newServer(t, data)
+		s.noEPSV, s.noRest = test.noEPSV, test.noRest
+		f, err := NewFTP(strings.Replace(test.url, "%s", s.Addr().String(), 1))
+		if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			s.Close()
+			continue
+		}
+		if l := f.Length(); l != int64(len(data)) {
+			t.Errorf("test %d: expecting length %d, got %d", n+1, len(data), l)
+		}
+		var wg sync.WaitGroup
+		for m, rng := range [...][2]int64{{0, -1}, {10, 20}, {50, -1}, {0, 5}} {
+			wg.Add(1)
+			go func(m int, start, length int64) {
+				defer wg.Done()
+				end := int64(len(data))
+				if length >= 0 {
+					end = start + length
+				}
+				r, err := f.NewReadCloser(start, length)
+				if err != nil {
+					t.Errorf("test %d.%d: unexpected error - %s", n+1, m+1, err)
+					return
+				}
+				defer r.Close()
+				if got, err := ioutil.ReadAll(r); err != nil {
+					t.Errorf("test %d.%d: unexpected error - %s", n+1, m+1, err)
+				} else if string(got) != data[start:end] {
+					t.Errorf("test %d.%d: expecting %q, got %q", n+1, m+1, data[start:end], got)
+				}
+			}(m, rng[0], rng[1])
+		}
+		wg.Wait()
+		if f.Sequential() != test.noRest {
+			t.Errorf("test %d: expecting Sequential %v, got %v", n+1, test.noRest, f.Sequential())
+		}
+		s.Close()
+	}
+}
+
+func TestFTPLogin(t *testing.T) {
+	s := newServer(t, "data")
+	defer s.Close()
+	if _, err := NewFTP("ftp://user:wrong@" + s.Addr().String() + "/file"); err == nil {
+		t.Error("expecting login error")
+	}
+	if _, err := NewFTP("ftp://" + s.Addr().String() + "/missing"); err == nil {
+		t.Error("expecting error for missing file")
+	}
+	if _, err := NewFTP("http://" + s.Addr().String() + "/file"); err == nil {
+		t.Error("expecting error for wrong scheme")
+	}
+}
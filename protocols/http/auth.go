@@ -0,0 +1,149 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Authenticator adds credentials to a request.
+type Authenticator interface {
+	Authenticate(r *http.Request)
+}
+
+// Refresher is implemented by an Authenticator whose credentials can be
+// renewed when they are rejected by the server. The request that was rejected
+// is passed so that, when several requests are rejected at once, the
+// credentials need only be renewed once.
+type Refresher interface {
+	Refresh(ctx context.Context, rejected *http.Request) error
+}
+
+// BasicAuth is an Authenticator that uses HTTP Basic authentication.
+type BasicAuth struct {
+	Username, Password string
+}
+
+// Authenticate sets the Authorization header of the request.
+func (b BasicAuth) Authenticate(r *http.Request) {
+	r.SetBasicAuth(b.Username, b.Password)
+}
+
+// BearerToken is an Authenticator that sends a bearer token, which is renewed
+// using a callback when it is rejected.
+type BearerToken struct {
+	mutex   sync.Mutex
+	token   string
+	refresh func(context.Context) (string, error)
+}
+
+// NewBearerToken creates a BearerToken with the given initial token, which
+// may be empty, and refresh callback, which may be nil.
+func NewBearerToken(token string, refresh func(context.Context) (string, error)) *BearerToken {
+	return &BearerToken{
+		token:   token,
+		refresh: refresh,
+	}
+}
+
+// Authenticate sets the Authorization header of the request, if there is a
+// token.
+func (b *BearerToken) Authenticate(r *http.Request) {
+	b.mutex.Lock()
+	token := b.token
+	b.mutex.Unlock()
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// Refresh gets a new token from the callback, unless the token has already
+// been renewed since the rejected request was sent.
+func (b *BearerToken) Refresh(ctx context.Context, rejected *http.Request) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.refresh == nil {
+		return NoRefresh{}
+	}
+	if sent := strings.TrimPrefix(rejected.Header.Get("Authorization"), "Bearer "); b.token != "" && sent != b.token {
+		return nil
+	}
+	token, err := b.refresh(ctx)
+	if err != nil {
+		return err
+	}
+	b.token = token
+	return nil
+}
+
+// Hosts maps host names to the Options used for requests to them.
+type Hosts struct {
+	mutex sync.RWMutex
+	hosts map[string]Options
+	netrc *Netrc
+}
+
+// DefaultHosts holds the Options used by NewHTTP and NewHTTPContext.
+var DefaultHosts Hosts
+
+// Set sets the options for a host, which may include a port.
+func (h *Hosts) Set(host string, o Options) {
+	h.mutex.Lock()
+	if h.hosts == nil {
+		h.hosts = make(map[string]Options)
+	}
+	h.hosts[strings.ToLower(host)] = o
+	h.mutex.Unlock()
+}
+
+// Remove removes the options for a host.
+func (h *Hosts) Remove(host string) {
+	h.mutex.Lock()
+	delete(h.hosts, strings.ToLower(host))
+	h.mutex.Unlock()
+}
+
+// SetNetrc sets the netrc data from which credentials are taken for hosts
+// that have no other authentication set. Only hosts named by a machine entry
+// are given credentials; the default entry is not used.
+func (h *Hosts) SetNetrc(n *Netrc) {
+	h.mutex.Lock()
+	h.netrc = n
+	h.mutex.Unlock()
+}
+
+// Get returns the options for a host, first matching on the host and port,
+// then on the host name alone.
+func (h *Hosts) Get(host string) Options {
+	host = strings.ToLower(host)
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	o, ok := h.hosts[host]
+	if !ok {
+		o = h.hosts[hostname(host)]
+	}
+	if o.Auth == nil && h.netrc != nil {
+		if b, ok := h.netrc.Lookup(hostname(host)); ok {
+			o.Auth = b
+		}
+	}
+	return o
+}
+
+// hostname strips any port from a host.
+func hostname(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Errors
+
+// NoRefresh is an error returned when rejected credentials can't be renewed.
+type NoRefresh struct{}
+
+func (NoRefresh) Error() string {
+	return "no way to refresh credentials"
+}
@@ -0,0 +1,192 @@
+package http
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseNetrc(t *testing.T) {
+	n, err := ParseNetrc(strings.NewReader(`# comment
+machine example.com login user password pass
+machine other.com
+	login other
+	password secret
+macdef init
+cd /pub
+bin
+
+machine Third.com login third password 3
+default login anon password guest
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for n2, test := range [...]struct {
+		host string
+		auth BasicAuth
+	}{
+		{"example.com", BasicAuth{"user", "pass"}},
+		{"other.com", BasicAuth{"other", "secret"}},
+		{"third.com", BasicAuth{"third", "3"}},
+	} {
+		if auth, ok := n.Lookup(test.host); !ok {
+			t.Errorf("test %d: no credentials found", n2+1)
+		} else if auth != test.auth {
+			t.Errorf("test %d: expecting %v, got %v", n2+1, test.auth, auth)
+		}
+	}
+	if auth, ok := n.Lookup("unknown.com"); ok {
+		t.Errorf("expecting no credentials for unknown host, got %v", auth)
+	}
+	if auth, ok := n.Default(); !ok {
+		t.Errorf("no default credentials found")
+	} else if auth != (BasicAuth{"anon", "guest"}) {
+		t.Errorf("expecting default %v, got %v", BasicAuth{"anon", "guest"}, auth)
+	}
+}
+
+func TestHosts(t *testing.T) {
+	var h Hosts
+	h.Set("example.com", Options{Referer: "a"})
+	h.Set("example.com:8080", Options{Referer: "b"})
+	n, _ := ParseNetrc(strings.NewReader("machine example.com login user password pass\ndefault login anon password guest"))
+	h.SetNetrc(n)
+	for m, test := range [...]struct {
+		host, referer string
+		auth          bool
+	}{
+		{"example.com", "a", true},
+		{"EXAMPLE.com:8080", "b", true},
+		{"example.com:9090", "a", true},
+		{"other.com", "", false},
+	} {
+		o := h.Get(test.host)
+		if o.Referer != test.referer {
+			t.Errorf("test %d: expecting referer %q, got %q", m+1, test.referer, o.Referer)
+		}
+		if (o.Auth != nil) != test.auth {
+			t.Errorf("test %d: expecting auth %v, got %v", m+1, test.auth, o.Auth)
+		}
+	}
+	h.Remove("example.com:8080")
+	if o := h.Get("example.com:8080"); o.Referer != "a" {
+		t.Errorf("expecting referer %q after removal, got %q", "a", o.Referer)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	data := "abcdefghijklmnopqrstuvwxyz"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer s.Close()
+
+	if _, err := NewHTTP(s.URL); err == nil {
+		t.Fatal("expecting error without credentials")
+	}
+	h, err := NewHTTPOptions(context.Background(), s.URL, Options{Auth: BasicAuth{"user", "pass"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r, err := h.NewReadCloser(5, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer r.Close()
+	if d, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(d) != data[5:10] {
+		t.Errorf("expecting %s, got %s", data[5:10], d)
+	}
+}
+
+func TestBearerRefresh(t *testing.T) {
+	data := "abcdefghijklmnopqrstuvwxyz"
+	var valid atomic.Value
+	valid.Store("first")
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+valid.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer s.Close()
+
+	var refreshes int32
+	b := NewBearerToken("", func(context.Context) (string, error) {
+		atomic.AddInt32(&refreshes, 1)
+		return valid.Load().(string), nil
+	})
+	h, err := NewHTTPOptions(context.Background(), s.URL, Options{Auth: b})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if refreshes != 1 {
+		t.Errorf("expecting 1 refresh, got %d", refreshes)
+	}
+	valid.Store("second")
+	r, err := h.NewReadCloser(0, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	d, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(d) != data[:5] {
+		t.Errorf("expecting %s, got %s", data[:5], d)
+	}
+	if refreshes != 2 {
+		t.Errorf("expecting 2 refreshes, got %d", refreshes)
+	}
+	if _, err := NewHTTPOptions(context.Background(), s.URL, Options{Auth: NewBearerToken("wrong", nil)}); err == nil {
+		t.Error("expecting error with no refresh callback")
+	}
+}
+
+func TestJar(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", MaxAge: 3600})
+		}
+		w.Write([]byte("data"))
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "jar")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cookies")
+
+	j, err := NewJar(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = NewHTTPOptions(context.Background(), s.URL, Options{Jar: j}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	j, err = NewJar(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	if cookies := j.Cookies(req.URL); len(cookies) != 1 || cookies[0].Value != "abc" {
+		t.Errorf("expecting saved session cookie, got %v", cookies)
+	}
+}
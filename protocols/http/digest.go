@@ -0,0 +1,119 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+// digestAlgorithms lists the supported digest algorithms, strongest first.
+var digestAlgorithms = [...]string{"sha-512", "sha-256", "sha", "md5"}
+
+// ParseDigest returns the strongest supported digest of the complete resource
+// from the headers of a response to a non-ranged request, taken from the
+// Repr-Digest, Digest or Content-MD5 headers.
+func ParseDigest(h http.Header) downloader.Digest {
+	if d := reprDigest(h); d.Sum != nil {
+		return d
+	}
+	return parseContentMD5(h)
+}
+
+// reprDigest returns the digest of the complete resource from the
+// Repr-Digest or Digest headers, which, unlike Content-MD5, can be used with
+// the response to a range request.
+func reprDigest(h http.Header) downloader.Digest {
+	for _, header := range [...]string{"Repr-Digest", "Digest"} {
+		if d := parseDigestHeader(h.Get(header)); d.Sum != nil {
+			return d
+		}
+	}
+	return downloader.Digest{}
+}
+
+// contentDigest returns the strongest supported digest of the body of a
+// ranged response, taken from the Content-Digest or Content-MD5 headers.
+func contentDigest(h http.Header) downloader.Digest {
+	if d := parseDigestHeader(h.Get("Content-Digest")); d.Sum != nil {
+		return d
+	}
+	return parseContentMD5(h)
+}
+
+func parseContentMD5(h http.Header) downloader.Digest {
+	d := downloader.Digest{Algorithm: "md5"}
+	if v := h.Get("Content-MD5"); v != "" {
+		d.Sum = decodeDigest(d, v)
+	}
+	return d
+}
+
+// parseDigestHeader parses both the RFC 3230 Digest header and the RFC 9530
+// Repr-Digest and Content-Digest headers, which differ in how the value is
+// encoded.
+func parseDigestHeader(header string) downloader.Digest {
+	values := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		values[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(strings.TrimSpace(kv[1]), ":")
+	}
+	for _, algorithm := range digestAlgorithms {
+		if v, ok := values[algorithm]; ok {
+			d := downloader.Digest{Algorithm: algorithm}
+			if d.Sum = decodeDigest(d, v); d.Sum != nil {
+				return d
+			}
+		}
+	}
+	return downloader.Digest{}
+}
+
+func decodeDigest(d downloader.Digest, v string) []byte {
+	sum, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(sum) != d.NewHash().Size() {
+		return nil
+	}
+	return sum
+}
+
+// verifyReader checks the data read from a response body against a digest,
+// returning a DigestMismatch error instead of io.EOF when they differ.
+type verifyReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	sum  []byte
+}
+
+func newVerifyReader(rc io.ReadCloser, d downloader.Digest) io.ReadCloser {
+	if d.Sum == nil {
+		return rc
+	}
+	return &verifyReader{
+		ReadCloser: rc,
+		hash:       d.NewHash(),
+		sum:        d.Sum,
+	}
+}
+
+// Verifying always returns true, as the data is checked once it has all been
+// read.
+func (v *verifyReader) Verifying() bool {
+	return true
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.hash.Sum(nil), v.sum) {
+		err = downloader.DigestMismatch{}
+	}
+	return n, err
+}
@@ -0,0 +1,94 @@
+package http
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+func TestParseDigest(t *testing.T) {
+	md5Sum := md5.Sum([]byte("hello"))
+	sha256Sum := sha256.Sum256([]byte("hello"))
+	md5B64 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	sha256B64 := base64.StdEncoding.EncodeToString(sha256Sum[:])
+	tests := []struct {
+		headers map[string]string
+		digest  downloader.Digest
+	}{
+		{nil, downloader.Digest{}},
+		{map[string]string{"Content-MD5": md5B64}, downloader.Digest{Algorithm: "md5", Sum: md5Sum[:]}},
+		{map[string]string{"Content-MD5": "invalid"}, downloader.Digest{}},
+		{map[string]string{"Digest": "MD5=" + md5B64}, downloader.Digest{Algorithm: "md5", Sum: md5Sum[:]}},
+		{map[string]string{"Digest": "MD5=" + md5B64 + ", SHA-256=" + sha256B64}, downloader.Digest{Algorithm: "sha-256", Sum: sha256Sum[:]}},
+		{map[string]string{"Digest": "unknown=abc, md5=" + md5B64}, downloader.Digest{Algorithm: "md5", Sum: md5Sum[:]}},
+		{map[string]string{"Repr-Digest": "sha-256=:" + sha256B64 + ":"}, downloader.Digest{Algorithm: "sha-256", Sum: sha256Sum[:]}},
+		{map[string]string{"Repr-Digest": "sha-256=:" + sha256B64 + ":", "Content-MD5": md5B64}, downloader.Digest{Algorithm: "sha-256", Sum: sha256Sum[:]}},
+		{map[string]string{"Repr-Digest": "sha-256=:" + md5B64 + ":"}, downloader.Digest{}},
+	}
+
+	for n, test := range tests {
+		h := make(http.Header)
+		for k, v := range test.headers {
+			h.Set(k, v)
+		}
+		d := ParseDigest(h)
+		if d.Sum == nil {
+			d = downloader.Digest{}
+		}
+		if !reflect.DeepEqual(d, test.digest) {
+			t.Errorf("test %d: expecting digest %v, got %v", n+1, test.digest, d)
+		}
+	}
+}
+
+func TestVerifyRange(t *testing.T) {
+	data := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	dataReader := strings.NewReader(data)
+	var corrupt bool
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			body := []byte(data[start : end+1])
+			sum := md5.Sum(body)
+			if corrupt {
+				sum[0]++
+			}
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		http.ServeContent(w, r, "data.txt", time.Now(), dataReader)
+	}))
+	defer s.Close()
+
+	h, err := NewHTTP(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, test := range [...]bool{false, true} {
+		corrupt = test
+		r, err := h.NewReadCloser(5, 10)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+		_, err = ioutil.ReadAll(r)
+		r.Close()
+		if test {
+			if _, ok := err.(downloader.DigestMismatch); !ok {
+				t.Errorf("test %d: expecting DigestMismatch, got %v", n+1, err)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		}
+	}
+}
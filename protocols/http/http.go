@@ -1,82 +1,293 @@
 package http
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
 )
 
 // HTTP turns an http request into a io.ReadCloser.
 type HTTP struct {
-	Client  *http.Client
+	Client *http.Client
+	// Request is the template from which each request is made. It is
+	// cloned for every call, and is never modified, so it should not be
+	// changed while the HTTP is in use.
 	Request *http.Request
+	// Options are applied to every request made from the template.
+	Options Options
 	Size    int64
-	sync.Mutex
+	// Digest is the checksum of the complete resource, if the server
+	// supplied one.
+	Digest downloader.Digest
+	// NoRanges is set when the server is known not to honour range
+	// requests.
+	NoRanges bool
+	// ETag and LastModified identify the version of the resource, when the
+	// server supplied them. Range requests are made conditional on them
+	// being unchanged.
+	ETag         string
+	LastModified time.Time
+	// Header holds the headers of the response from which the length was
+	// determined, such as Content-Type and Content-Disposition.
+	Header http.Header
+	mutex  sync.Mutex
+}
+
+// Options contains the per-source settings added to each request.
+type Options struct {
+	// Header contains extra headers to send.
+	Header http.Header
+	// Cookies are added to the Cookie header.
+	Cookies   []*http.Cookie
+	Referer   string
+	UserAgent string
+	// Auth, if set, adds credentials to each request. If it also
+	// implements Refresher, a request that is rejected with a 401 status
+	// is retried once with renewed credentials.
+	Auth Authenticator
+	// Jar, if set, supplies cookies for each request and stores those
+	// that are received.
+	Jar http.CookieJar
+}
+
+// apply adds the options to a request.
+func (o *Options) apply(r *http.Request) {
+	for k, v := range o.Header {
+		r.Header[k] = append(r.Header[k], v...)
+	}
+	for _, c := range o.Cookies {
+		r.AddCookie(c)
+	}
+	if o.Referer != "" {
+		r.Header.Set("Referer", o.Referer)
+	}
+	if o.UserAgent != "" {
+		r.Header.Set("User-Agent", o.UserAgent)
+	}
+	if o.Jar != nil {
+		for _, c := range o.Jar.Cookies(r.URL) {
+			r.AddCookie(c)
+		}
+	}
+	if o.Auth != nil {
+		o.Auth.Authenticate(r)
+	}
 }
 
 // NewHTTP is a constructor for a simple http GET request. For a more complex
 // construction, use the struct directly.
 func NewHTTP(url string) (*HTTP, error) {
+	return NewHTTPContext(context.Background(), url)
+}
+
+// NewHTTPContext acts like NewHTTP, but uses the given context for the initial
+// length request. The options for the host are taken from DefaultHosts.
+func NewHTTPContext(ctx context.Context, url string) (*HTTP, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	return newHTTP(ctx, req, DefaultHosts.Get(req.URL.Host))
+}
+
+// NewHTTPOptions acts like NewHTTPContext, but applies the given options to
+// every request, including the initial length request.
+func NewHTTPOptions(ctx context.Context, url string, o Options) (*HTTP, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTP(ctx, req, o)
+}
+
+func newHTTP(ctx context.Context, req *http.Request, o Options) (*HTTP, error) {
 	h := &HTTP{
 		Client:  http.DefaultClient,
 		Request: req,
+		Options: o,
 	}
-	err = h.GetLength()
-	if err != nil {
+	if err := h.GetLengthContext(ctx); err != nil {
 		return nil, err
 	}
 	return h, nil
 }
 
 // GetLength sends a HEAD request in order to determine the content length
+// and whether the server honours range requests. If the HEAD request fails or
+// is rejected, or no length is sent in response to it, a GET request for
+// the first byte is sent instead. When the server doesn't send a length at
+// all, such as for a chunk-encoded stream, the Size is set to
+// downloader.UnknownLength.
 func (h *HTTP) GetLength() error {
-	old := h.Request.Method
-	h.Request.Method = "HEAD"
-	resp, err := h.Client.Do(h.Request)
-	h.Request.Method = old
-	if err != nil {
+	return h.GetLengthContext(context.Background())
+}
+
+// GetLengthContext acts like GetLength, but stops when the context is
+// cancelled.
+func (h *HTTP) GetLengthContext(ctx context.Context) error {
+	resp, err := h.do(ctx, "HEAD", nil)
+	if err == nil {
+		resp.Body.Close()
+	} else if ctx.Err() != nil {
 		return err
 	}
-	if len(resp.Header.Get("Content-Length")) == 0 {
-		return NoLength{}
+	var info resource
+	if err != nil || resp.StatusCode/100 != 2 || len(resp.Header.Get("Content-Length")) == 0 {
+		if info, err = h.probe(ctx); err != nil {
+			return err
+		}
+	} else {
+		info = resource{
+			size:     resp.ContentLength,
+			noRanges: resp.Header.Get("Accept-Ranges") == "none",
+			digest:   ParseDigest(resp.Header),
+		}
+		info.setValidators(resp.Header)
 	}
-	h.Size = resp.ContentLength
+	h.mutex.Lock()
+	h.Size = info.size
+	h.NoRanges = info.noRanges
+	h.Digest = info.digest
+	h.ETag = info.etag
+	h.LastModified = info.lastModified
+	h.Header = info.header
+	h.mutex.Unlock()
 	return nil
 }
 
-// NewReadCloser returns a new io.ReadCloser with the start and end bounds set
+// newRequest returns a copy of the template request, bound to the given
+// context, with the method set and the options applied.
+func (h *HTTP) newRequest(ctx context.Context, method string) *http.Request {
+	r := h.Request.Clone(ctx)
+	r.Method = method
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	h.Options.apply(r)
+	return r
+}
+
+// do sends a request with the given method and extra headers, returning the
+// response. Received cookies are stored in the jar, and a request rejected
+// for its credentials is retried once if they can be refreshed.
+func (h *HTTP) do(ctx context.Context, method string, extra http.Header) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		r := h.newRequest(ctx, method)
+		for k, v := range extra {
+			r.Header[k] = v
+		}
+		resp, err := h.Client.Do(r)
+		if err != nil {
+			return nil, err
+		}
+		if h.Options.Jar != nil {
+			if cookies := resp.Cookies(); len(cookies) > 0 {
+				h.Options.Jar.SetCookies(resp.Request.URL, cookies)
+			}
+		}
+		if resp.StatusCode != http.StatusUnauthorized || retried {
+			return resp, nil
+		}
+		rf, ok := h.Options.Auth.(Refresher)
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if err = rf.Refresh(ctx, r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resource returns a copy of what is known about the resource.
+func (h *HTTP) resource() resource {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return resource{
+		size:         h.Size,
+		noRanges:     h.NoRanges,
+		digest:       h.Digest,
+		etag:         h.ETag,
+		lastModified: h.LastModified,
+	}
+}
+
+// NewReadCloser returns a new io.ReadCloser with the start and end bounds set.
+// A negative length reads to the end of the resource.
 func (h *HTTP) NewReadCloser(start, length int64) (io.ReadCloser, error) {
-	h.Lock()
-	defer h.Unlock()
-	if length < 0 {
-		length = h.Size
+	return h.NewReadCloserContext(context.Background(), start, length)
+}
+
+// NewReadCloserContext acts like NewReadCloser, but the request is bound to the
+// given context. It is safe to call concurrently.
+func (h *HTTP) NewReadCloserContext(ctx context.Context, start, length int64) (io.ReadCloser, error) {
+	info := h.resource()
+	if info.size >= 0 {
+		if length < 0 {
+			length = info.size
+		}
+		if start+length > info.size {
+			length = info.size - start
+		}
 	}
-	if start+length > h.Size {
-		length = h.Size - start
+	var rng string
+	if length >= 0 && (start > 0 || length != info.size) {
+		rng = "bytes=" + strconv.Itoa(int(start)) + "-" + strconv.Itoa(int(start+length-1))
+	} else if length < 0 && start > 0 {
+		rng = "bytes=" + strconv.Itoa(int(start)) + "-"
 	}
+	var extra http.Header
 	expecting := http.StatusOK
-	if start > 0 || length != h.Size {
-		h.Request.Header.Add("Range", "bytes="+strconv.Itoa(int(start))+"-"+strconv.Itoa(int(start+length-1)))
-		defer h.Request.Header.Del("Range")
+	if rng != "" && !info.noRanges {
+		extra = http.Header{"Range": {rng}}
+		if ir := info.ifRange(); ir != "" {
+			extra.Set("If-Range", ir)
+		}
 		expecting = http.StatusPartialContent
 	}
-	r, err := h.Client.Do(h.Request)
+	r, err := h.do(ctx, "GET", extra)
 	if err != nil {
 		return nil, err
 	}
+	if err = info.validate(r, start, length); err != nil {
+		r.Body.Close()
+		return nil, err
+	}
+	if rng != "" && r.StatusCode == http.StatusOK {
+		h.mutex.Lock()
+		h.NoRanges = true
+		h.mutex.Unlock()
+		return skip(r, start, length)
+	}
 	if r.StatusCode != expecting {
+		r.Body.Close()
 		return nil, UnexpectedStatus{r.StatusCode, expecting}
 	}
-	return r.Body, nil
+	if r.Uncompressed {
+		return r.Body, nil
+	}
+	d := contentDigest(r.Header)
+	if d.Sum == nil && expecting == http.StatusOK {
+		d = ParseDigest(r.Header)
+	}
+	return newVerifyReader(r.Body, d), nil
+}
+
+// Host returns the host that requests are sent to
+func (h *HTTP) Host() string {
+	return h.Request.URL.Host
 }
 
-// Length returns the total length of the request
+// Length returns the total length of the request, or
+// downloader.UnknownLength if it could not be determined.
 func (h *HTTP) Length() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 	return h.Size
 }
 
@@ -90,6 +301,23 @@ func (NoLength) Error() string {
 	return "could not determine length"
 }
 
+// BadContentRange is an error returned when a partial response has a missing
+// or malformed Content-Range header.
+type BadContentRange string
+
+func (b BadContentRange) Error() string {
+	return "invalid Content-Range: " + strconv.Quote(string(b))
+}
+
+// RangesIgnored is an error returned when the server doesn't honour a range
+// request, and skipping to the start of the range would mean discarding too
+// much data.
+type RangesIgnored struct{}
+
+func (RangesIgnored) Error() string {
+	return "server ignored range request"
+}
+
 // UnexpectedStatus is an error returned when a non-200 status is received.
 type UnexpectedStatus struct {
 	Got, Expected int
@@ -98,3 +326,9 @@ type UnexpectedStatus struct {
 func (u UnexpectedStatus) Error() string {
 	return "received status " + strconv.Itoa(u.Got) + ", expecting " + strconv.Itoa(u.Expected)
 }
+
+// Expired returns true when the status shows that the URL is no longer
+// valid, as happens when a signed URL expires.
+func (u UnexpectedStatus) Expired() bool {
+	return u.Got == http.StatusForbidden || u.Got == http.StatusGone
+}
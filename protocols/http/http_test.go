@@ -1,37 +1,58 @@
 package http
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/MJKWoolnough/downloader"
 )
 
 func TestGetLength(t *testing.T) {
-	var lengthStr string
+	const data = "abcdefghij"
+	var (
+		lengthStr   string
+		probeStatus int
+	)
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if lengthStr != "" {
-			w.Header().Add("Content-Length", lengthStr)
+		if r.Method == "HEAD" {
+			if lengthStr != "" {
+				w.Header().Add("Content-Length", lengthStr)
+			}
+			return
+		}
+		if probeStatus != 0 {
+			w.WriteHeader(probeStatus)
+			return
 		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
 	}))
+	defer s.Close()
 
 	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
 	tests := []struct {
-		lengthStr string
-		length    int64
-		err       string
+		lengthStr   string
+		probeStatus int
+		length      int64
+		err         string
 	}{
-		{"5", 5, ""},
-		{"25", 25, ""},
-		{"a", 0, "Head " + s.URL + ": bad Content-Length \"a\""},
-		{"-1", 0, "Head " + s.URL + ": bad Content-Length \"-1\""},
+		{"5", 0, 5, ""},
+		{"25", 0, 25, ""},
+		{"a", 0, int64(len(data)), ""},
+		{"-1", 0, int64(len(data)), ""},
+		{"a", http.StatusInternalServerError, 0, UnexpectedStatus{http.StatusInternalServerError, http.StatusOK}.Error()},
 	}
 
 	for n, test := range tests {
 		lengthStr = test.lengthStr
+		probeStatus = test.probeStatus
 		h, err := NewHTTP(s.URL)
 		errStr := ""
 		if err != nil {
@@ -54,9 +75,10 @@ func TestGetLength(t *testing.T) {
 func TestNewReadCloser(t *testing.T) {
 	data := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	dataReader := strings.NewReader(data)
+	modTime := time.Now()
 
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeContent(w, r, "data.txt", time.Now(), dataReader)
+		http.ServeContent(w, r, "data.txt", modTime, dataReader)
 	}))
 
 	h, err := NewHTTP(s.URL)
@@ -89,3 +111,138 @@ func TestNewReadCloser(t *testing.T) {
 		}
 	}
 }
+
+func TestUnknownLength(t *testing.T) {
+	data := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			return
+		}
+		start := 0
+		if rng := r.Header.Get("Range"); rng == "bytes=0-0" {
+			w.Header().Set("Content-Range", "bytes 0-0/*")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(data[:1]))
+			return
+		} else if rng != "" {
+			start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(len(data)-1)+"/*")
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		for _, c := range data[start:] {
+			w.Write([]byte{byte(c)})
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer s.Close()
+
+	h, err := NewHTTP(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l := h.Length(); l != downloader.UnknownLength {
+		t.Fatalf("expecting unknown length, got %d", l)
+	}
+
+	for n, start := range [...]int64{0, 10} {
+		r, err := h.NewReadCloser(start, -1)
+		if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			continue
+		}
+		if d, err := ioutil.ReadAll(r); err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+		} else if string(d) != data[start:] {
+			t.Errorf("test %d: expecting %s, got %s", n+1, data[start:], d)
+		}
+		r.Close()
+	}
+}
+
+func TestParallelRequests(t *testing.T) {
+	const parallel = 4
+	data := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	modTime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var (
+		arrived sync.WaitGroup
+		ready   = make(chan struct{})
+	)
+	arrived.Add(parallel)
+	go func() {
+		arrived.Wait()
+		close(ready)
+	}()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "http://example.com/" || r.Header.Get("User-Agent") != "test-agent" || r.Header.Get("X-Test") != "value" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method == "GET" {
+			// Each range request waits until all of them have arrived,
+			// which can only happen if they are sent in parallel.
+			arrived.Done()
+			select {
+			case <-ready:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		http.ServeContent(w, r, "", modTime, strings.NewReader(data))
+	}))
+	defer s.Close()
+
+	h, err := NewHTTPOptions(context.Background(), s.URL, Options{
+		Header:    http.Header{"X-Test": []string{"value"}},
+		Cookies:   []*http.Cookie{{Name: "session", Value: "abc"}},
+		Referer:   "http://example.com/",
+		UserAgent: "test-agent",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l := h.Length(); l != int64(len(data)) {
+		t.Fatalf("expecting length %d, got %d", len(data), l)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results [parallel]string
+		errs    [parallel]error
+	)
+	for n := range results {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			start := int64(n * 10)
+			r, err := h.NewReadCloser(start, 10)
+			if err != nil {
+				errs[n] = err
+				return
+			}
+			d, err := ioutil.ReadAll(r)
+			r.Close()
+			results[n], errs[n] = string(d), err
+		}(n)
+	}
+	wg.Wait()
+	select {
+	case <-ready:
+	default:
+		t.Fatal("requests were not sent in parallel")
+	}
+	for n, got := range results {
+		if errs[n] != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, errs[n])
+		} else if expected := data[n*10 : n*10+10]; got != expected {
+			t.Errorf("test %d: expecting %s, got %s", n+1, expected, got)
+		}
+	}
+	if h.Request.Header.Get("Range") != "" || h.Request.Method != "GET" {
+		t.Error("template request was modified")
+	}
+}
@@ -0,0 +1,112 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Jar is an http.CookieJar that saves its cookies to a file, so that they
+// persist between runs.
+type Jar struct {
+	*cookiejar.Jar
+	filename string
+	mutex    sync.Mutex
+	cookies  map[string][]*http.Cookie
+}
+
+// NewJar creates a Jar that is stored in the given file, loading any cookies
+// already saved there.
+func NewJar(filename string) (*Jar, error) {
+	cj, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	j := &Jar{
+		Jar:      cj,
+		filename: filename,
+		cookies:  make(map[string][]*http.Cookie),
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(f).Decode(&j.cookies)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for origin, cookies := range j.cookies {
+		u, err := url.Parse(origin)
+		if err != nil {
+			delete(j.cookies, origin)
+			continue
+		}
+		live := cookies[:0]
+		for _, c := range cookies {
+			if c.Expires.IsZero() || c.Expires.After(now) {
+				live = append(live, c)
+			}
+		}
+		j.cookies[origin] = live
+		j.Jar.SetCookies(u, live)
+	}
+	return j, nil
+}
+
+// SetCookies stores the cookies received from the given URL, and saves the
+// jar.
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	origin := u.Scheme + "://" + u.Host
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	stored := j.cookies[origin]
+Cookies:
+	for _, c := range cookies {
+		cc := *c
+		c = &cc
+		if c.MaxAge > 0 {
+			c.Expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second)
+			c.MaxAge = 0
+		} else if c.MaxAge < 0 {
+			c.Expires = time.Unix(1, 0)
+			c.MaxAge = 0
+		}
+		for n, s := range stored {
+			if s.Name == c.Name && s.Domain == c.Domain && s.Path == c.Path {
+				stored[n] = c
+				continue Cookies
+			}
+		}
+		stored = append(stored, c)
+	}
+	j.cookies[origin] = stored
+	// There is no way to report an error from SetCookies, so a jar that
+	// fails to save will still work, but won't persist.
+	j.save()
+}
+
+// save writes the cookies to the file, replacing it atomically.
+func (j *Jar) save() error {
+	tmp := j.filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(f).Encode(j.cookies); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.filename)
+}
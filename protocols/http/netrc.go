@@ -0,0 +1,126 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Netrc contains the credentials read from a .netrc file.
+type Netrc struct {
+	machines map[string]BasicAuth
+	def      *BasicAuth
+}
+
+// LoadNetrc reads a .netrc file. If the filename is empty, the file named by
+// the NETRC environment variable is used, or, failing that, .netrc in the
+// home directory.
+func LoadNetrc(filename string) (*Netrc, error) {
+	if filename == "" {
+		if filename = os.Getenv("NETRC"); filename == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			filename = filepath.Join(home, ".netrc")
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseNetrc(f)
+}
+
+// ParseNetrc parses the contents of a .netrc file.
+func ParseNetrc(r io.Reader) (*Netrc, error) {
+	n := &Netrc{machines: make(map[string]BasicAuth)}
+	var (
+		current *BasicAuth
+		machine string
+		macro   bool
+	)
+	store := func() {
+		if current == nil {
+			return
+		}
+		if machine == "" {
+			if n.def == nil {
+				n.def = current
+			}
+		} else if _, ok := n.machines[machine]; !ok {
+			n.machines[machine] = *current
+		}
+		current = nil
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if macro {
+			// A macro definition ends with an empty line.
+			macro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			var value string
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				store()
+				machine = strings.ToLower(value)
+				current = new(BasicAuth)
+				i++
+			case "default":
+				store()
+				machine = ""
+				current = new(BasicAuth)
+			case "login":
+				if current != nil {
+					current.Username = value
+				}
+				i++
+			case "password":
+				if current != nil {
+					current.Password = value
+				}
+				i++
+			case "account":
+				i++
+			case "macdef":
+				macro = true
+				i = len(fields)
+			default:
+				if strings.HasPrefix(fields[i], "#") {
+					i = len(fields)
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	store()
+	return n, nil
+}
+
+// Lookup returns the credentials for a host named by a machine entry. The
+// default entry is never matched, as it would send the credentials to any
+// host; use Default to retrieve it.
+func (n *Netrc) Lookup(host string) (BasicAuth, bool) {
+	b, ok := n.machines[strings.ToLower(host)]
+	return b, ok
+}
+
+// Default returns the credentials of the default entry, if there is one.
+func (n *Netrc) Default() (BasicAuth, bool) {
+	if n.def != nil {
+		return *n.def, true
+	}
+	return BasicAuth{}, false
+}
@@ -0,0 +1,212 @@
+package http
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+// maxSkip is the most data that will be discarded from the start of a
+// response when the server ignores a range request.
+const maxSkip = 4 << 20
+
+// resource contains what is known about the resource being downloaded.
+type resource struct {
+	size         int64
+	noRanges     bool
+	digest       downloader.Digest
+	etag         string
+	lastModified time.Time
+	header       http.Header
+}
+
+// probe determines the length of the resource, and whether the server honours
+// range requests, for servers that mishandle HEAD requests. It first asks for
+// the first byte of the resource, then, if the server rejects that, for the
+// whole resource, closing the body of either as soon as the headers arrive.
+func (h *HTTP) probe(ctx context.Context) (resource, error) {
+	resp, err := h.do(ctx, "GET", http.Header{"Range": {"bytes=0-0"}})
+	if err != nil {
+		return resource{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		cr := resp.Header.Get("Content-Range")
+		start, end, size, ok := parseContentRange(cr)
+		if !ok || start != 0 || end != 0 {
+			return resource{}, BadContentRange(cr)
+		}
+		info := resource{
+			size:   size,
+			digest: reprDigest(resp.Header),
+		}
+		info.setValidators(resp.Header)
+		return info, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// An empty resource has no first byte to return.
+		cr := resp.Header.Get("Content-Range")
+		if _, _, size, ok := parseContentRange(cr); ok && size == 0 {
+			info := resource{
+				digest: reprDigest(resp.Header),
+			}
+			info.setValidators(resp.Header)
+			return info, nil
+		}
+	case http.StatusOK:
+		return fromFull(resp), nil
+	}
+	if resp, err = h.do(ctx, "GET", nil); err != nil {
+		return resource{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resource{}, UnexpectedStatus{resp.StatusCode, http.StatusOK}
+	}
+	return fromFull(resp), nil
+}
+
+// fromFull determines the length and digest from a response to a request for
+// the whole resource that was sent in place of a range request.
+func fromFull(resp *http.Response) resource {
+	info := resource{
+		size:     resp.ContentLength,
+		noRanges: true,
+		digest:   ParseDigest(resp.Header),
+	}
+	if len(resp.Header.Get("Content-Length")) == 0 {
+		info.size = downloader.UnknownLength
+	}
+	info.setValidators(resp.Header)
+	return info
+}
+
+// setValidators records the headers of a response, including the ETag and
+// Last-Modified headers.
+func (r *resource) setValidators(hdr http.Header) {
+	r.header = hdr
+	r.etag = hdr.Get("ETag")
+	r.lastModified, _ = http.ParseTime(hdr.Get("Last-Modified"))
+}
+
+// ifRange returns the value for an If-Range header, which must be a strong
+// ETag or a date, or an empty string if there is neither.
+func (r *resource) ifRange() string {
+	if r.etag != "" && !strings.HasPrefix(r.etag, "W/") {
+		return r.etag
+	}
+	if !r.lastModified.IsZero() {
+		return r.lastModified.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
+
+// changed determines whether the headers of a response show that the
+// resource is no longer the one whose length was determined.
+func (r *resource) changed(hdr http.Header) bool {
+	if etag := hdr.Get("ETag"); etag != "" && r.etag != "" {
+		return etag != r.etag
+	}
+	if lm, err := http.ParseTime(hdr.Get("Last-Modified")); err == nil && !r.lastModified.IsZero() {
+		return !lm.Equal(r.lastModified)
+	}
+	return false
+}
+
+// validate checks that a response is for the same version of the resource,
+// and, for a partial response, that its Content-Range matches the range that
+// was requested.
+func (r *resource) validate(resp *http.Response, start, length int64) error {
+	if r.changed(resp.Header) {
+		return downloader.ResourceChanged{}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if r.size >= 0 && resp.ContentLength >= 0 && resp.ContentLength != r.size {
+			return downloader.ResourceChanged{}
+		}
+	case http.StatusPartialContent:
+		cr := resp.Header.Get("Content-Range")
+		s, e, size, ok := parseContentRange(cr)
+		if !ok || s != start || length >= 0 && e != start+length-1 {
+			return BadContentRange(cr)
+		}
+		if r.size >= 0 && size >= 0 && size != r.size {
+			return downloader.ResourceChanged{}
+		}
+	}
+	return nil
+}
+
+// parseContentRange parses the value of a Content-Range header, as either
+// "bytes start-end/size" or "bytes */size". A size of "*" is returned as
+// downloader.UnknownLength, and an unsatisfied range as a start and end of
+// -1.
+func parseContentRange(cr string) (start, end, size int64, ok bool) {
+	if !strings.HasPrefix(cr, "bytes ") {
+		return 0, 0, 0, false
+	}
+	cr = strings.TrimSpace(cr[6:])
+	slash := strings.IndexByte(cr, '/')
+	if slash < 0 {
+		return 0, 0, 0, false
+	}
+	rng, total := cr[:slash], cr[slash+1:]
+	var err error
+	if total == "*" {
+		size = downloader.UnknownLength
+	} else if size, err = strconv.ParseInt(total, 10, 64); err != nil || size < 0 {
+		return 0, 0, 0, false
+	}
+	if rng == "*" {
+		return -1, -1, size, size >= 0
+	}
+	dash := strings.IndexByte(rng, '-')
+	if dash < 0 {
+		return 0, 0, 0, false
+	}
+	if start, err = strconv.ParseInt(rng[:dash], 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, false
+	}
+	if end, err = strconv.ParseInt(rng[dash+1:], 10, 64); err != nil || end < start || size >= 0 && end >= size {
+		return 0, 0, 0, false
+	}
+	return start, end, size, true
+}
+
+// Sequential returns true when the server is known not to honour range
+// requests, so that the data can only be read efficiently from the start.
+func (h *HTTP) Sequential() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.NoRanges
+}
+
+// skip turns the complete response sent in place of a range request into a
+// ReadCloser for that range, by discarding the data before it. If there is
+// too much data to discard, RangesIgnored is returned.
+func skip(r *http.Response, start, length int64) (io.ReadCloser, error) {
+	if start > maxSkip {
+		r.Body.Close()
+		return nil, RangesIgnored{}
+	}
+	if _, err := io.CopyN(ioutil.Discard, r.Body, start); err != nil {
+		r.Body.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return r.Body, nil
+	}
+	return limitedReadCloser{io.LimitReader(r.Body, length), r.Body}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,258 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+func TestParseContentRange(t *testing.T) {
+	for n, test := range [...]struct {
+		header           string
+		start, end, size int64
+		ok               bool
+	}{
+		{"bytes 0-0/100", 0, 0, 100, true},
+		{"bytes 10-19/20", 10, 19, 20, true},
+		{"bytes 5-9/*", 5, 9, downloader.UnknownLength, true},
+		{"bytes */100", -1, -1, 100, true},
+		{"bytes */*", 0, 0, 0, false},
+		{"bytes 10-20/20", 0, 0, 0, false},
+		{"bytes 10-5/20", 0, 0, 0, false},
+		{"bytes 0-0", 0, 0, 0, false},
+		{"items 0-0/1", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	} {
+		start, end, size, ok := parseContentRange(test.header)
+		if ok != test.ok {
+			t.Errorf("test %d: expecting ok %v, got %v", n+1, test.ok, ok)
+		} else if ok && (start != test.start || end != test.end || size != test.size) {
+			t.Errorf("test %d: expecting %d-%d/%d, got %d-%d/%d", n+1, test.start, test.end, test.size, start, end, size)
+		}
+	}
+}
+
+func TestGetLengthFallback(t *testing.T) {
+	const data = "abcdefghijklmnopqrstuvwxyz"
+	for n, test := range [...]struct {
+		handler  http.HandlerFunc
+		size     int64
+		noRanges bool
+		err      error
+	}{
+		{ // HEAD rejected, ranges honoured
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.Header().Set("Content-Range", "bytes 0-0/"+strconv.Itoa(len(data)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(data[:1]))
+			},
+			int64(len(data)), false, nil,
+		},
+		{ // HEAD rejected, ranges ignored
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Write([]byte(data))
+			},
+			int64(len(data)), true, nil,
+		},
+		{ // HEAD without length, unknown length with ranges
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					return
+				}
+				w.Header().Set("Content-Range", "bytes 0-0/*")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(data[:1]))
+			},
+			downloader.UnknownLength, false, nil,
+		},
+		{ // HEAD rejected, empty resource
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.Header().Set("Content-Range", "bytes */0")
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			},
+			0, false, nil,
+		},
+		{ // HEAD and range rejected, plain GET accepted
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" || r.Header.Get("Range") != "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Write([]byte(data))
+			},
+			int64(len(data)), true, nil,
+		},
+		{ // HEAD honoured, but ranges not supported
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Accept-Ranges", "none")
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				if r.Method != "HEAD" {
+					w.Write([]byte(data))
+				}
+			},
+			int64(len(data)), true, nil,
+		},
+		{ // HEAD connection closed, ranges honoured
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					if c, _, err := w.(http.Hijacker).Hijack(); err == nil {
+						c.Close()
+					}
+					return
+				}
+				w.Header().Set("Content-Range", "bytes 0-0/"+strconv.Itoa(len(data)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(data[:1]))
+			},
+			int64(len(data)), false, nil,
+		},
+		{ // Not found
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			0, false, UnexpectedStatus{http.StatusNotFound, http.StatusOK},
+		},
+		{ // Bad Content-Range
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "HEAD" {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.Header().Set("Content-Range", "bytes 0-5/26")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(data[:6]))
+			},
+			0, false, BadContentRange("bytes 0-5/26"),
+		},
+	} {
+		s := httptest.NewServer(test.handler)
+		h, err := NewHTTP(s.URL)
+		s.Close()
+		if err != test.err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.err, err)
+		} else if err == nil && (h.Size != test.size || h.NoRanges != test.noRanges) {
+			t.Errorf("test %d: expecting size %d and NoRanges %v, got %d and %v", n+1, test.size, test.noRanges, h.Size, h.NoRanges)
+		}
+	}
+}
+
+func TestIgnoredRange(t *testing.T) {
+	data := strings.Repeat("abcdefghijklmnopqrstuvwxyz", maxSkip/26+2)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method != "HEAD" {
+			w.Write([]byte(data))
+		}
+	}))
+	defer s.Close()
+
+	h, err := NewHTTP(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.Sequential() {
+		t.Errorf("expecting ranges to be assumed to be supported")
+	}
+	for n, test := range [...]struct {
+		start, length int64
+		err           error
+	}{
+		{5, 10, nil},
+		{0, 26, nil},
+		{100, -1, nil},
+		{maxSkip + 1, 10, RangesIgnored{}},
+	} {
+		r, err := h.NewReadCloser(test.start, test.length)
+		if err != test.err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.err, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		end := int64(len(data))
+		if test.length >= 0 {
+			end = test.start + test.length
+		}
+		if d, err := ioutil.ReadAll(r); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if string(d) != data[test.start:end] {
+			t.Errorf("test %d: read incorrect data", n+1)
+		}
+		r.Close()
+		if !h.Sequential() {
+			t.Errorf("test %d: expecting downloader to be sequential", n+1)
+		}
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+	const data = "abcdefghijklmnopqrstuvwxyz"
+	var (
+		etag         = `"v1"`
+		contentRange string
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if contentRange != "" && r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", contentRange)
+			w.WriteHeader(http.StatusPartialContent)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer s.Close()
+
+	h, err := NewHTTP(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h.ETag != `"v1"` {
+		t.Fatalf("expecting ETag %q, got %q", `"v1"`, h.ETag)
+	}
+	for n, test := range [...]struct {
+		etag, contentRange string
+		start, length      int64
+		err                error
+	}{
+		{`"v1"`, "", 5, 10, nil},
+		{`"v1"`, "", 0, 26, nil},
+		{`"v2"`, "", 5, 10, downloader.ResourceChanged{}},
+		{`"v2"`, "", 0, 26, downloader.ResourceChanged{}},
+		{`"v1"`, "bytes 6-15/26", 5, 10, BadContentRange("bytes 6-15/26")},
+		{`"v1"`, "bytes 5-15/26", 5, 10, BadContentRange("bytes 5-15/26")},
+		{`"v1"`, "bytes 5-14/30", 5, 10, downloader.ResourceChanged{}},
+	} {
+		etag, contentRange = test.etag, test.contentRange
+		r, err := h.NewReadCloser(test.start, test.length)
+		if err != test.err {
+			t.Errorf("test %d: expecting error %v, got %v", n+1, test.err, err)
+		} else if err == nil {
+			if d, err := ioutil.ReadAll(r); err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if string(d) != data[test.start:test.start+test.length] {
+				t.Errorf("test %d: read incorrect data", n+1)
+			}
+			r.Close()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package sftp
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// conn is a connection to an SFTP server.
+type conn struct {
+	nc     net.Conn
+	ssh    *ssh.Client
+	client *sftp.Client
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// connect dials the server, authenticates and starts the SFTP subsystem. The
+// connection is closed if the context is cancelled before close is called.
+func (s *SFTP) connect(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: s.Config.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	c := &conn{
+		nc:   nc,
+		stop: make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-c.stop:
+		}
+	}()
+	sc, chans, reqs, err := ssh.NewClientConn(nc, s.Addr, s.Config)
+	if err != nil {
+		c.close()
+		return nil, ctxErr(ctx, err)
+	}
+	c.ssh = ssh.NewClient(sc, chans, reqs)
+	if c.client, err = sftp.NewClient(c.ssh); err != nil {
+		c.close()
+		return nil, ctxErr(ctx, err)
+	}
+	return c, nil
+}
+
+// ctxErr returns the error of the context, if it has been cancelled, in place
+// of the error caused by the connection being closed.
+func ctxErr(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.stop)
+		if c.client != nil {
+			c.client.Close()
+		}
+		if c.ssh != nil {
+			c.ssh.Close()
+		}
+		c.nc.Close()
+	})
+}
@@ -0,0 +1,178 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type server struct {
+	net.Listener
+	config *ssh.ServerConfig
+	key    ssh.PublicKey
+	wg     sync.WaitGroup
+
+	mutex sync.Mutex
+	conns int
+}
+
+func newServer(t *testing.T) *server {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &server{
+		Listener: l,
+		config: &ssh.ServerConfig{
+			PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				if c.User() == "user" && string(password) == "pass" {
+					return nil, nil
+				}
+				return nil, os.ErrPermission
+			},
+		},
+		key: signer.PublicKey(),
+	}
+	s.config.AddHostKey(signer)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *server) Close() {
+	s.Listener.Close()
+	s.wg.Wait()
+}
+
+func (s *server) Conns() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conns
+}
+
+func (s *server) serve(c net.Conn) {
+	defer s.wg.Done()
+	defer c.Close()
+	sc, chans, reqs, err := ssh.NewServerConn(c, s.config)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+	s.mutex.Lock()
+	s.conns++
+	s.mutex.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if srv, err := sftp.NewServer(ch, sftp.ReadOnly()); err == nil {
+						srv.Serve()
+					}
+					ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	data := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	filename := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	srv := newServer(t)
+	defer srv.Close()
+	config := &ssh.ClientConfig{HostKeyCallback: ssh.FixedHostKey(srv.key)}
+	base := "sftp://user:pass@" + srv.Addr().String()
+
+	if _, err = NewSFTP("ftp://"+srv.Addr().String()+filename, config); err != UnsupportedScheme("ftp") {
+		t.Errorf("expecting UnsupportedScheme, got %v", err)
+	}
+	if _, err = NewSFTP("sftp://user:wrong@"+srv.Addr().String()+filename, config); err == nil {
+		t.Error("expecting error for bad password")
+	}
+	if _, err = NewSFTP(base+filepath.Join(dir, "missing"), config); err == nil {
+		t.Error("expecting error for missing file")
+	}
+	s, err := NewSFTP(base+filename, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l := s.Length(); l != int64(len(data)) {
+		t.Fatalf("expecting length %d, got %d", len(data), l)
+	}
+	conns := srv.Conns()
+	var wg sync.WaitGroup
+	for n, rng := range [...][2]int64{{0, -1}, {10, 20}, {50, -1}, {0, 5}} {
+		wg.Add(1)
+		go func(n int, start, length int64) {
+			defer wg.Done()
+			end := int64(len(data))
+			if length >= 0 {
+				end = start + length
+			}
+			r, err := s.NewReadCloser(start, length)
+			if err != nil {
+				t.Errorf("test %d: unexpected error - %s", n+1, err)
+				return
+			}
+			defer r.Close()
+			if got, err := ioutil.ReadAll(r); err != nil {
+				t.Errorf("test %d: unexpected error - %s", n+1, err)
+			} else if string(got) != data[start:end] {
+				t.Errorf("test %d: expecting %q, got %q", n+1, data[start:end], got)
+			}
+		}(n, rng[0], rng[1])
+	}
+	wg.Wait()
+	if c := srv.Conns() - conns; c != 4 {
+		t.Errorf("expecting 4 connections, got %d", c)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = s.NewReadCloserContext(ctx, 0, -1); err != context.Canceled {
+		t.Errorf("expecting context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package downloader
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Priorities for Sites. Sites with higher priorities are tried first, and
+// those with equal priorities in the order that they were registered.
+const (
+	PriorityFallback = -100
+	PriorityDefault  = 0
+	PriorityHigh     = 100
+)
+
+// DefaultRegistry is the Registry used by the package level functions.
+var DefaultRegistry = NewRegistry()
+
+// Registry is a set of named Sites, which are tried in order of priority to
+// find the one that handles a URL.
+type Registry struct {
+	mutex sync.RWMutex
+	sites siteList
+	seq   uint64
+}
+
+// SiteInfo describes a Site in a Registry.
+type SiteInfo struct {
+	Name     string
+	Site     Site
+	Priority int
+	Disabled bool
+	seq      uint64
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+// Register adds a Site to the Registry with the given name and priority. If a
+// Site with that name is already registered, a number is added to the name to
+// make it unique. The name used is returned.
+func (r *Registry) Register(name string, s Site, priority int) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	unique := name
+	for n := 2; r.find(unique) >= 0; n++ {
+		unique = name + "-" + strconv.Itoa(n)
+	}
+	r.sites = append(r.sites, SiteInfo{
+		Name:     unique,
+		Site:     s,
+		Priority: priority,
+		seq:      r.seq,
+	})
+	r.seq++
+	sort.Sort(r.sites)
+	return unique
+}
+
+// Unregister removes the named Site, returning false if there was none.
+func (r *Registry) Unregister(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := r.find(name)
+	if n < 0 {
+		return false
+	}
+	r.sites = append(r.sites[:n], r.sites[n+1:]...)
+	return true
+}
+
+// SetPriority changes the priority of the named Site, returning false if there
+// is no such Site.
+func (r *Registry) SetPriority(name string, priority int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := r.find(name)
+	if n < 0 {
+		return false
+	}
+	r.sites[n].Priority = priority
+	sort.Sort(r.sites)
+	return true
+}
+
+// SetDisabled disables or re-enables the named Site, returning false if there
+// is no such Site. A disabled Site remains registered, but is never tried.
+func (r *Registry) SetDisabled(name string, disabled bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := r.find(name)
+	if n < 0 {
+		return false
+	}
+	r.sites[n].Disabled = disabled
+	return true
+}
+
+// Sites returns the registered Sites, in the order that they are tried.
+func (r *Registry) Sites() []SiteInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	sites := make([]SiteInfo, len(r.sites))
+	copy(sites, r.sites)
+	return sites
+}
+
+// find returns the position of the named Site, or -1. The mutex must be held.
+func (r *Registry) find(name string) int {
+	for n, s := range r.sites {
+		if s.Name == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// DoRequest finds the first enabled Site that matches the url, and returns
+// its Request. A ConfirmSite must also confirm the match, and a Site whose
+// Request returns an error for which IsNotMine is true is passed over. Any
+// other error, including one from Confirm, is returned.
+func (r *Registry) DoRequest(url string) (*Request, error) {
+	return r.DoRequestContext(context.Background(), url)
+}
+
+// DoRequestContext acts like DoRequest, but passes the context to any Site
+// that implements ContextSite.
+func (r *Registry) DoRequestContext(ctx context.Context, url string) (*Request, error) {
+	for _, si := range r.Sites() {
+		if si.Disabled || !si.Site.Match(url) {
+			continue
+		}
+		if cs, ok := si.Site.(ConfirmSite); ok {
+			if ok, err := cs.Confirm(ctx, url); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+		}
+		var (
+			req *Request
+			err error
+		)
+		if cs, ok := si.Site.(ContextSite); ok {
+			req, err = cs.RequestContext(ctx, url)
+		} else if err = ctx.Err(); err == nil {
+			req, err = si.Site.Request(url)
+		}
+		if IsNotMine(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for n := range req.Downloaders {
+			if req.Downloaders[n].Origin == nil {
+				req.Downloaders[n].Origin = si.Site
+			}
+		}
+		if req.Metadata.Site == "" {
+			req.Metadata.Site = si.Name
+		}
+		return req, nil
+	}
+	return nil, NoRequest{}
+}
+
+// typeName returns the name of the type of a Site, for Sites registered
+// without a name.
+func typeName(s Site) string {
+	t := reflect.TypeOf(s)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.PkgPath() == "" {
+		return t.String()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+type siteList []SiteInfo
+
+func (s siteList) Len() int {
+	return len(s)
+}
+
+func (s siteList) Less(i, j int) bool {
+	if s[i].Priority != s[j].Priority {
+		return s[i].Priority > s[j].Priority
+	}
+	return s[i].seq < s[j].seq
+}
+
+func (s siteList) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
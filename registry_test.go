@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+type testSite struct {
+	prefix, name string
+}
+
+func (t testSite) Match(url string) bool {
+	return strings.HasPrefix(url, t.prefix)
+}
+
+func (t testSite) Request(string) (*Request, error) {
+	return &Request{Filename: t.name, Downloaders: []Media{{}}}, nil
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.Register("any", testSite{"", "any"}, PriorityFallback)
+	r.Register("a", testSite{"a", "a"}, PriorityDefault)
+	if name := r.Register("a", testSite{"ab", "ab"}, PriorityDefault); name != "a-2" {
+		t.Errorf("expecting name %q, got %q", "a-2", name)
+	}
+	r.Register("abc", testSite{"abc", "abc"}, PriorityHigh)
+
+	for n, test := range [...]struct {
+		setup      func()
+		url, found string
+	}{
+		{func() {}, "abcd", "abc"},
+		{func() {}, "abd", "a"},
+		{func() { r.SetPriority("a-2", PriorityHigh) }, "abd", "ab"},
+		{func() { r.SetDisabled("a-2", true) }, "abd", "a"},
+		{func() { r.Unregister("a") }, "abd", "any"},
+		{func() { r.SetDisabled("a-2", false) }, "abd", "ab"},
+		{func() { r.Unregister("any") }, "xyz", ""},
+	} {
+		test.setup()
+		req, err := r.DoRequest(test.url)
+		if test.found == "" {
+			if _, ok := err.(NoRequest); !ok {
+				t.Errorf("test %d: expecting NoRequest error, got %v", n+1, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			continue
+		}
+		if req.Filename != test.found {
+			t.Errorf("test %d: expecting site %q, got %q", n+1, test.found, req.Filename)
+		}
+		if req.Downloaders[0].Origin == nil {
+			t.Errorf("test %d: expecting Origin to be set", n+1)
+		}
+		if req.Metadata.Site == "" {
+			t.Errorf("test %d: expecting Site name to be set", n+1)
+		}
+	}
+
+	var names []string
+	for _, si := range r.Sites() {
+		names = append(names, si.Name)
+	}
+	if got := strings.Join(names, ","); got != "a-2,abc" {
+		t.Errorf("expecting sites %q, got %q", "a-2,abc", got)
+	}
+	if r.Unregister("missing") || r.SetDisabled("missing", true) || r.SetPriority("missing", 0) {
+		t.Error("expecting false for missing site")
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	if name := typeName(new(testSite)); name != "github.com/MJKWoolnough/downloader.testSite" {
+		t.Errorf("unexpected name %q", name)
+	}
+}
+
+type confirmSite struct {
+	testSite
+	confirm bool
+	err     error
+}
+
+func (c confirmSite) Confirm(context.Context, string) (bool, error) {
+	return c.confirm, c.err
+}
+
+type notMineSite struct {
+	testSite
+}
+
+func (notMineSite) Request(string) (*Request, error) {
+	return nil, NotMine{}
+}
+
+func TestFallthrough(t *testing.T) {
+	r := NewRegistry()
+	r.Register("generic", testSite{"", "generic"}, PriorityFallback)
+	r.Register("unconfirmed", confirmSite{testSite{"a", "unconfirmed"}, false, nil}, PriorityHigh)
+	r.Register("notmine", notMineSite{testSite{"ab", "notmine"}}, PriorityHigh)
+	r.Register("confirmed", confirmSite{testSite{"abc", "confirmed"}, true, nil}, PriorityDefault)
+	r.Register("failed", confirmSite{testSite{"abcd", "failed"}, false, io.ErrUnexpectedEOF}, PriorityHigh)
+	for n, test := range [...]struct {
+		url, found string
+	}{
+		{"a", "generic"},
+		{"ab", "generic"},
+		{"abc", "confirmed"},
+		{"x", "generic"},
+	} {
+		req, err := r.DoRequest(test.url)
+		if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+		} else if req.Filename != test.found {
+			t.Errorf("test %d: expecting site %q, got %q", n+1, test.found, req.Filename)
+		}
+	}
+	if _, err := r.DoRequest("abcd"); err != io.ErrUnexpectedEOF {
+		t.Errorf("expecting confirmation error, got %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package downloader
+
+import (
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Selector filters and ranks the Media of a Request, e.g. to find the best
+// mp4 up to 720p, or the smallest webm.
+type Selector struct {
+	Filters []Filter
+	Order   []Order
+}
+
+// Field is a property of Media that can be filtered or ordered on.
+type Field string
+
+// Fields available to a Selector. The numeric fields are Width, Height,
+// Bitrate, VideoBitrate, AudioBitrate, Size and Duration, which is in seconds;
+// the rest are compared as strings. Codec matches either the video or the
+// audio codec.
+const (
+	FieldMime         Field = "mime"
+	FieldWidth        Field = "width"
+	FieldHeight       Field = "height"
+	FieldBitrate      Field = "bitrate"
+	FieldVideoBitrate Field = "vbitrate"
+	FieldAudioBitrate Field = "abitrate"
+	FieldSize         Field = "size"
+	FieldDuration     Field = "duration"
+	FieldCodec        Field = "codec"
+	FieldVideoCodec   Field = "vcodec"
+	FieldAudioCodec   Field = "acodec"
+	FieldLanguage     Field = "lang"
+	FieldContainer    Field = "container"
+)
+
+// Op is a comparison operator for a Filter.
+type Op string
+
+// Comparison operators. Contains checks for a substring, and so is only
+// useful for string fields; the others compare numeric fields as numbers.
+const (
+	OpEqual        Op = "="
+	OpNotEqual     Op = "!="
+	OpLess         Op = "<"
+	OpLessEqual    Op = "<="
+	OpGreater      Op = ">"
+	OpGreaterEqual Op = ">="
+	OpContains     Op = "~"
+)
+
+// ops are the operators in the order they are looked for when parsing, so
+// that no operator is found in place of a longer one that contains it.
+var ops = [...]Op{OpNotEqual, OpLessEqual, OpGreaterEqual, OpEqual, OpLess, OpGreater, OpContains}
+
+// Filter passes Media whose field compares to the value with the operator.
+// Media for which a numeric field is unknown never pass.
+type Filter struct {
+	Field Field
+	Op    Op
+	Value string
+}
+
+// Order ranks Media by a numeric field, with Media for which it is unknown
+// always ranked last.
+type Order struct {
+	Field      Field
+	Descending bool
+}
+
+// ParseSelector parses a selector expression, which is a comma separated list
+// of terms. A term is either a filter, such as "height<=720" or "mime~webm",
+// or an ordering, which is a field name for ascending order, optionally
+// prefixed with "+", or a field name prefixed with "-" for descending order,
+// such as "-bitrate". As a "+" in a URL query decodes to a space, "size",
+// "+size" and " size" are all the same ordering. The terms "best" and "worst"
+// are shorthand for ordering by height and then bitrate, descending and
+// ascending respectively.
+func ParseSelector(expr string) (Selector, error) {
+	var s Selector
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case term == "":
+		case term == "best" || term == "worst":
+			desc := term == "best"
+			s.Order = append(s.Order, Order{FieldHeight, desc}, Order{FieldBitrate, desc})
+		case Field(strings.ToLower(term)).numeric():
+			s.Order = append(s.Order, Order{Field(strings.ToLower(term)), false})
+		case term[0] == '+' || term[0] == '-':
+			f := Field(strings.ToLower(term[1:]))
+			if !f.numeric() {
+				return Selector{}, BadSelector(term)
+			}
+			s.Order = append(s.Order, Order{f, term[0] == '-'})
+		default:
+			f, err := parseFilter(term)
+			if err != nil {
+				return Selector{}, err
+			}
+			s.Filters = append(s.Filters, f)
+		}
+	}
+	return s, nil
+}
+
+func parseFilter(term string) (Filter, error) {
+	for _, op := range ops {
+		p := strings.Index(term, string(op))
+		if p <= 0 {
+			continue
+		}
+		f := Filter{
+			Field: Field(strings.ToLower(strings.TrimSpace(term[:p]))),
+			Op:    op,
+			Value: strings.TrimSpace(term[p+len(op):]),
+		}
+		if !f.Field.valid() {
+			return Filter{}, BadSelector(term)
+		}
+		if f.Field.numeric() {
+			if op == OpContains {
+				return Filter{}, BadSelector(term)
+			}
+			if _, err := strconv.ParseInt(strings.TrimSuffix(f.Value, "p"), 10, 64); err != nil {
+				return Filter{}, BadSelector(term)
+			}
+		}
+		return f, nil
+	}
+	return Filter{}, BadSelector(term)
+}
+
+func (f Field) valid() bool {
+	switch f {
+	case FieldMime, FieldCodec, FieldVideoCodec, FieldAudioCodec, FieldLanguage, FieldContainer:
+		return true
+	}
+	return f.numeric()
+}
+
+func (f Field) numeric() bool {
+	switch f {
+	case FieldWidth, FieldHeight, FieldBitrate, FieldVideoBitrate, FieldAudioBitrate, FieldSize, FieldDuration:
+		return true
+	}
+	return false
+}
+
+// number returns the value of a numeric field, which is zero or less if
+// unknown.
+func (f Field) number(m *Media) int64 {
+	switch f {
+	case FieldWidth:
+		return int64(m.Width)
+	case FieldHeight:
+		return int64(m.Height)
+	case FieldBitrate:
+		return int64(m.Bitrate)
+	case FieldVideoBitrate:
+		return int64(m.VideoBitrate)
+	case FieldAudioBitrate:
+		return int64(m.AudioBitrate)
+	case FieldSize:
+		return m.Size
+	case FieldDuration:
+		return int64(m.Duration / time.Second)
+	}
+	return 0
+}
+
+// strings returns the values of a string field.
+func (f Field) strings(m *Media) []string {
+	switch f {
+	case FieldMime:
+		if mt, _, err := mime.ParseMediaType(m.MimeType); err == nil {
+			return []string{mt}
+		}
+		return []string{m.MimeType}
+	case FieldCodec:
+		return []string{m.VideoCodec, m.AudioCodec}
+	case FieldVideoCodec:
+		return []string{m.VideoCodec}
+	case FieldAudioCodec:
+		return []string{m.AudioCodec}
+	case FieldLanguage:
+		return []string{m.AudioLanguage}
+	case FieldContainer:
+		return []string{m.Container}
+	}
+	return nil
+}
+
+// Match determines whether the Media passes the filter.
+func (f Filter) Match(m *Media) bool {
+	if f.Field.numeric() {
+		v := f.Field.number(m)
+		if v <= 0 {
+			return false
+		}
+		n, _ := strconv.ParseInt(strings.TrimSuffix(f.Value, "p"), 10, 64)
+		switch f.Op {
+		case OpEqual:
+			return v == n
+		case OpNotEqual:
+			return v != n
+		case OpLess:
+			return v < n
+		case OpLessEqual:
+			return v <= n
+		case OpGreater:
+			return v > n
+		case OpGreaterEqual:
+			return v >= n
+		}
+		return false
+	}
+	value := strings.ToLower(f.Value)
+	for _, s := range f.Field.strings(m) {
+		s = strings.ToLower(s)
+		switch f.Op {
+		case OpEqual:
+			if s == value {
+				return true
+			}
+		case OpNotEqual:
+			if s == value {
+				return false
+			}
+		case OpContains:
+			if strings.Contains(s, value) {
+				return true
+			}
+		}
+	}
+	return f.Op == OpNotEqual
+}
+
+// Match determines whether the Media passes all of the filters.
+func (s Selector) Match(m *Media) bool {
+	for _, f := range s.Filters {
+		if !f.Match(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the Media of the Request that pass the filters, ranked by
+// the ordering. Media that rank equally keep their order in the Request.
+func (s Selector) Select(r *Request) []Media {
+	selected := make([]Media, 0, len(r.Downloaders))
+	for _, m := range r.Downloaders {
+		if s.Match(&m) {
+			selected = append(selected, m)
+		}
+	}
+	sort.Stable(mediaList{selected, s.Order})
+	return selected
+}
+
+// Best returns the highest ranked Media of the Request that passes the
+// filters, or false if none do.
+func (s Selector) Best(r *Request) (Media, bool) {
+	selected := s.Select(r)
+	if len(selected) == 0 {
+		return Media{}, false
+	}
+	return selected[0], true
+}
+
+type mediaList struct {
+	media []Media
+	order []Order
+}
+
+func (m mediaList) Len() int {
+	return len(m.media)
+}
+
+func (m mediaList) Less(i, j int) bool {
+	for _, o := range m.order {
+		a, b := o.Field.number(&m.media[i]), o.Field.number(&m.media[j])
+		if a == b {
+			continue
+		} else if a <= 0 || b <= 0 {
+			return b <= 0
+		} else if o.Descending {
+			return a > b
+		}
+		return a < b
+	}
+	return false
+}
+
+func (m mediaList) Swap(i, j int) {
+	m.media[i], m.media[j] = m.media[j], m.media[i]
+}
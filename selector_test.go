@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSelector(t *testing.T) {
+	r := &Request{
+		Downloaders: []Media{
+			{UID: "a", MimeType: "video/mp4", Height: 1080, Width: 1920, Bitrate: 4000000, Size: 4000, VideoCodec: "avc1.640028", AudioCodec: "mp4a.40.2"},
+			{UID: "b", MimeType: "video/webm", Height: 720, Width: 1280, Bitrate: 1500000, Size: 1200, VideoCodec: "vp9", AudioCodec: "opus"},
+			{UID: "c", MimeType: "video/mp4", Height: 720, Width: 1280, Bitrate: 2000000, Size: 2000, VideoCodec: "avc1.4d401f", AudioCodec: "mp4a.40.2"},
+			{UID: "d", MimeType: "video/webm", Height: 360, Width: 640, Bitrate: 500000, Size: 500, VideoCodec: "vp8", AudioCodec: "vorbis"},
+			{UID: "e", MimeType: "audio/mp4; codecs=\"mp4a.40.2\"", Bitrate: 128000, Size: 100, AudioCodec: "mp4a.40.2"},
+			{UID: "f", MimeType: "video/3gpp", Size: 300},
+			{UID: "g", MimeType: "video/mp4", Height: 720, VideoBitrate: 1800000, AudioBitrate: 192000, Duration: 90 * time.Second, AudioLanguage: "en-GB", Container: "mp4"},
+			{UID: "h", MimeType: "video/webm", Height: 480, VideoBitrate: 800000, AudioBitrate: 128000, Duration: 30 * time.Second, AudioLanguage: "fr", Container: "webm"},
+		},
+	}
+	for n, test := range [...]struct {
+		expr, uids string
+		err        bool
+	}{
+		{"", "abcdefgh", false},
+		{"mime~mp4,height<=720p,best", "cg", false},
+		{"mime=video/webm,+size", "dbh", false},
+		{"best", "acbghdef", false},
+		{"worst", "dhbcgaef", false},
+		{"-size", "acbdfegh", false},
+		{"mime=audio/mp4", "e", false},
+		{"codec~mp4a,-bitrate", "ace", false},
+		{"vcodec=vp9", "b", false},
+		{"acodec!=mp4a.40.2", "bdfgh", false},
+		{"height>360,height<1080", "bcgh", false},
+		{"width>=1280,-width,+bitrate", "abc", false},
+		{"bitrate=500000", "d", false},
+		{"duration>=60", "g", false},
+		{"lang~en", "g", false},
+		{"container=webm,+abitrate", "h", false},
+		{"mime=video/webm,size", "dbh", false},
+		{"width>=1280,-width,bitrate", "abc", false},
+		{"vbitrate>0,-vbitrate", "gh", false},
+		{"height~720", "", true},
+		{"colour=red", "", true},
+		{"height<=big", "", true},
+		{"+mime", "", true},
+		{"mime", "", true},
+		{"nonsense", "", true},
+	} {
+		s, err := ParseSelector(test.expr)
+		if test.err {
+			if err == nil {
+				t.Errorf("test %d: expecting error", n+1)
+			} else if _, ok := err.(BadSelector); !ok {
+				t.Errorf("test %d: expecting BadSelector error, got %s", n+1, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			continue
+		}
+		var uids string
+		for _, m := range s.Select(r) {
+			uids += m.UID
+		}
+		if uids != test.uids {
+			t.Errorf("test %d: expecting %q, got %q", n+1, test.uids, uids)
+		}
+		if m, ok := s.Best(r); ok != (test.uids != "") || ok && m.UID != test.uids[:1] {
+			t.Errorf("test %d: unexpected best media %q", n+1, m.UID)
+		}
+	}
+}
+
+func TestSelectorQuery(t *testing.T) {
+	r := &Request{
+		Downloaders: []Media{
+			{UID: "a", MimeType: "video/webm", Height: 720, Size: 1200},
+			{UID: "b", MimeType: "video/mp4", Height: 720, Size: 2000},
+			{UID: "c", MimeType: "video/webm", Height: 360, Size: 500},
+		},
+	}
+	for n, test := range [...]struct {
+		query, uids string
+	}{
+		{"select=mime%3Dvideo/webm,+size", "ca"},
+		{"select=mime%3Dvideo/webm,%2Bsize", "ca"},
+		{"select=mime%3Dvideo/webm,size", "ca"},
+		{"select=-size", "bac"},
+		{"select=height<=720,+height,-size", "cba"},
+	} {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			continue
+		}
+		s, err := ParseSelector(q.Get("select"))
+		if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			continue
+		}
+		var uids string
+		for _, m := range s.Select(r) {
+			uids += m.UID
+		}
+		if uids != test.uids {
+			t.Errorf("test %d: expecting %q, got %q", n+1, test.uids, uids)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package direct
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/MJKWoolnough/downloader"
+	phttp "github.com/MJKWoolnough/downloader/protocols/http"
+)
+
+func match(text string) bool {
+	text = strings.ToLower(text)
+	return strings.HasPrefix(text, "http://") || strings.HasPrefix(text, "https://")
+}
+
+// filename determines the name of the file from the Content-Disposition
+// header, falling back to the last element of the URL path, or the host. An
+// extension is added for the mime type if the name has none.
+func filename(u *url.URL, disposition, mimeType string) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(disposition); err == nil {
+		name = path.Base(strings.Replace(params["filename"], "\\", "/", -1))
+	}
+	if name == "" || name == "." || name == "/" {
+		name = path.Base(u.Path)
+	}
+	if name == "" || name == "." || name == "/" {
+		name = u.Hostname()
+	}
+	if path.Ext(name) == "" && mimeType != "" {
+		if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+// uid identifies the version of the resource at a URL by its ETag, or, when
+// there is none, by its size and modification time. These are hashed, along
+// with the URL, so that the UID has a fixed length.
+func uid(u string, h *phttp.HTTP) string {
+	version := h.ETag
+	if version == "" {
+		version = strconv.FormatInt(h.Size, 10)
+		if !h.LastModified.IsZero() {
+			version += "-" + strconv.FormatInt(h.LastModified.Unix(), 10)
+		}
+	}
+	sum := sha256.Sum256([]byte(u + "\x00" + version))
+	return "http-" + hex.EncodeToString(sum[:])
+}
+
+func request(ctx context.Context, text string) (*downloader.Request, error) {
+	u, err := url.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	h, err := phttp.NewHTTPContext(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	var mimeType string
+	if mt, _, err := mime.ParseMediaType(h.Header.Get("Content-Type")); err == nil {
+		mimeType = mt
+	}
+	name := filename(u, h.Header.Get("Content-Disposition"), mimeType)
+	return &downloader.Request{
+		Filename: name,
+		Metadata: downloader.Metadata{
+			Title: strings.TrimSuffix(name, path.Ext(name)),
+			URL:   text,
+		},
+		Downloaders: []downloader.Media{
+			{
+				Size:         h.Size,
+				MimeType:     mimeType,
+				UID:          uid(text, h),
+				LastModified: h.LastModified,
+				Sources:      []downloader.Downloader{h},
+				Digest:       h.Digest,
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,118 @@
+package direct
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	phttp "github.com/MJKWoolnough/downloader/protocols/http"
+)
+
+func TestFilename(t *testing.T) {
+	for n, test := range [...]struct {
+		url, disposition, mime, filename string
+	}{
+		{"http://example.com/dir/file.mp4", "", "video/mp4", "file.mp4"},
+		{"http://example.com/dir/file.mp4?x=1", `attachment; filename="other.webm"`, "video/webm", "other.webm"},
+		{"http://example.com/dl", `attachment; filename="../../etc/passwd"`, "", "passwd"},
+		{"http://example.com/dl", `attachment; filename*=UTF-8''caf%C3%A9.txt`, "", "café.txt"},
+		{"http://example.com/dl", "", "image/gif", "dl.gif"},
+		{"http://example.com/", "", "", "example.com"},
+		{"http://example.com/dir%20name/my%20file.txt", "", "", "my file.txt"},
+	} {
+		u, _ := url.Parse(test.url)
+		if f := filename(u, test.disposition, test.mime); f != test.filename {
+			t.Errorf("test %d: expecting filename %q, got %q", n+1, test.filename, f)
+		}
+	}
+}
+
+func TestUID(t *testing.T) {
+	modTime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	long := "http://example.com/" + strings.Repeat("a", 1000)
+	for n, test := range [...]struct {
+		a, b   string
+		ha, hb *phttp.HTTP
+		same   bool
+	}{
+		{"http://example.com/a", "http://example.com/a", &phttp.HTTP{ETag: `"v1"`}, &phttp.HTTP{ETag: `"v1"`}, true},
+		{"http://example.com/a", "http://example.com/a", &phttp.HTTP{ETag: `"v1"`}, &phttp.HTTP{ETag: `"v2"`}, false},
+		{"http://example.com/a", "http://example.com/b", &phttp.HTTP{ETag: `"v1"`}, &phttp.HTTP{ETag: `"v1"`}, false},
+		{"http://example.com/a", "http://example.com/a", &phttp.HTTP{Size: 10, LastModified: modTime}, &phttp.HTTP{Size: 10, LastModified: modTime}, true},
+		{"http://example.com/a", "http://example.com/a", &phttp.HTTP{Size: 10, LastModified: modTime}, &phttp.HTTP{Size: 11, LastModified: modTime}, false},
+		{"http://example.com/a", "http://example.com/a", &phttp.HTTP{Size: 10}, &phttp.HTTP{Size: 10, LastModified: modTime}, false},
+		{long, long + "b", &phttp.HTTP{Size: 10}, &phttp.HTTP{Size: 10}, false},
+	} {
+		a, b := uid(test.a, test.ha), uid(test.b, test.hb)
+		if (a == b) != test.same {
+			t.Errorf("test %d: expecting UIDs to match %v, got %q and %q", n+1, test.same, a, b)
+		}
+		if len(a) != len(b) || len(a) > 100 {
+			t.Errorf("test %d: expecting short, fixed length, UIDs, got %q and %q", n+1, a, b)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	data := "abcdefghijklmnopqrstuvwxyz"
+	modTime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		mt := modTime
+		switch r.URL.Path {
+		case "/tagged":
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Disposition", `attachment; filename="letters.txt"`)
+		case "/undated.txt":
+			mt = time.Time{}
+		}
+		http.ServeContent(w, r, "", mt, strings.NewReader(data))
+	}))
+	defer s.Close()
+
+	for n, test := range [...]struct {
+		path, filename string
+		modTime        time.Time
+	}{
+		{"/tagged", "letters.txt", modTime},
+		{"/plain.txt", "plain.txt", modTime},
+		{"/undated.txt", "undated.txt", time.Time{}},
+	} {
+		if !match(s.URL + test.path) {
+			t.Errorf("test %d: expecting match", n+1)
+		}
+		r, err := request(context.Background(), s.URL+test.path)
+		if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			continue
+		}
+		m := r.Downloaders[0]
+		if r.Filename != test.filename {
+			t.Errorf("test %d: expecting filename %q, got %q", n+1, test.filename, r.Filename)
+		}
+		if r2, err := request(context.Background(), s.URL+test.path); err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+		} else if r2.Downloaders[0].UID != m.UID || !r2.Downloaders[0].LastModified.Equal(m.LastModified) {
+			t.Errorf("test %d: expecting repeated request to give the same UID and mod time", n+1)
+		}
+		if !strings.HasPrefix(m.UID, "http-") || strings.Contains(m.UID, s.URL) {
+			t.Errorf("test %d: expecting hashed UID, got %q", n+1, m.UID)
+		}
+		if m.MimeType != "text/plain" {
+			t.Errorf("test %d: expecting mime type %q, got %q", n+1, "text/plain", m.MimeType)
+		}
+		if m.Size != int64(len(data)) {
+			t.Errorf("test %d: expecting size %d, got %d", n+1, len(data), m.Size)
+		}
+		if !m.LastModified.Equal(test.modTime) {
+			t.Errorf("test %d: expecting mod time %s, got %s", n+1, test.modTime, m.LastModified)
+		}
+	}
+	if match("ftp://example.com/file") {
+		t.Error("expecting no match for ftp URL")
+	}
+}
@@ -0,0 +1,29 @@
+// +build !testing
+
+// Package direct implements a Site for direct links to files over http(s),
+// which is registered as a fallback so that more specific Sites are preferred.
+package direct
+
+import (
+	"context"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+func init() {
+	downloader.DefaultRegistry.Register("direct", new(direct), downloader.PriorityFallback)
+}
+
+type direct struct{}
+
+func (direct) Match(text string) bool {
+	return match(text)
+}
+
+func (direct) Request(text string) (*downloader.Request, error) {
+	return request(context.Background(), text)
+}
+
+func (direct) RequestContext(ctx context.Context, text string) (*downloader.Request, error) {
+	return request(ctx, text)
+}
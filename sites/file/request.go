@@ -0,0 +1,122 @@
+package file
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/MJKWoolnough/downloader"
+	pfile "github.com/MJKWoolnough/downloader/protocols/file"
+)
+
+// sniffLen is the number of bytes read from the start of a file to determine
+// its mime type.
+const sniffLen = 512
+
+func match(text string) bool {
+	return strings.HasPrefix(strings.ToLower(text), "file://")
+}
+
+// path returns the local path of a file:// URL, which must not name a remote
+// host.
+func path(text string) (string, error) {
+	u, err := url.Parse(text)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(u.Scheme, "file") {
+		return "", NotFileURL(text)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", RemoteHost(u.Host)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// mimeType determines the mime type of a file by sniffing its contents,
+// falling back to its extension when the contents are not recognised.
+func mimeType(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	mt := http.DetectContentType(buf[:n])
+	if strings.HasPrefix(mt, "application/octet-stream") || strings.HasPrefix(mt, "text/plain") {
+		if et := mime.TypeByExtension(filepath.Ext(p)); et != "" {
+			mt = et
+		}
+	}
+	return mt, nil
+}
+
+func request(ctx context.Context, text string) (*downloader.Request, error) {
+	p, err := path(text)
+	if err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, pfile.IsDir(p)
+	}
+	mt, err := mimeType(p)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(p)
+	return &downloader.Request{
+		Filename: name,
+		Metadata: downloader.Metadata{
+			Title: strings.TrimSuffix(name, filepath.Ext(name)),
+			URL:   text,
+		},
+		Downloaders: []downloader.Media{
+			{
+				Size:         fi.Size(),
+				MimeType:     mt,
+				UID:          "file-" + p + "-" + strconv.FormatInt(fi.Size(), 10) + "-" + strconv.FormatInt(fi.ModTime().UnixNano(), 10),
+				LastModified: fi.ModTime(),
+				Sources: []downloader.Downloader{
+					&pfile.File{
+						Path: p,
+						Size: fi.Size(),
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// Errors
+
+// NotFileURL is an error returned when a URL is not a file:// URL.
+type NotFileURL string
+
+func (n NotFileURL) Error() string {
+	return "not a file URL: " + string(n)
+}
+
+// RemoteHost is an error returned when a file:// URL names a host other than
+// the local one.
+type RemoteHost string
+
+func (r RemoteHost) Error() string {
+	return "file URL names a remote host: " + string(r)
+}
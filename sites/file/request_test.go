@@ -0,0 +1,76 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-site-test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	modTime := time.Unix(1234567890, 0)
+	for _, f := range [...]struct {
+		name, data string
+	}{
+		{"page.html", "<html><body>Hello</body></html>"},
+		{"image.gif", "GIF89a..."},
+		{"data.json", `{"a": 1}`},
+		{"unknown", "\x00\x01\x02"},
+	} {
+		p := filepath.Join(dir, f.name)
+		if err = ioutil.WriteFile(p, []byte(f.data), 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		os.Chtimes(p, modTime, modTime)
+	}
+	for n, test := range [...]struct {
+		url, filename, mime string
+		size                int64
+		err                 bool
+	}{
+		{"file://" + filepath.ToSlash(dir) + "/page.html", "page.html", "text/html; charset=utf-8", 31, false},
+		{"file://localhost" + filepath.ToSlash(dir) + "/image.gif", "image.gif", "image/gif", 9, false},
+		{"file://" + filepath.ToSlash(dir) + "/data.json", "data.json", "application/json", 8, false},
+		{"file://" + filepath.ToSlash(dir) + "/unknown", "unknown", "application/octet-stream", 3, false},
+		{"file://" + filepath.ToSlash(dir) + "/missing", "", "", 0, true},
+		{"file://" + filepath.ToSlash(dir), "", "", 0, true},
+		{"file://remote/share/file", "", "", 0, true},
+	} {
+		if !match(test.url) {
+			t.Errorf("test %d: expecting match", n+1)
+		}
+		r, err := request(context.Background(), test.url)
+		if test.err {
+			if err == nil {
+				t.Errorf("test %d: expecting error", n+1)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error - %s", n+1, err)
+			continue
+		}
+		m := r.Downloaders[0]
+		if r.Filename != test.filename {
+			t.Errorf("test %d: expecting filename %q, got %q", n+1, test.filename, r.Filename)
+		}
+		if m.MimeType != test.mime {
+			t.Errorf("test %d: expecting mime type %q, got %q", n+1, test.mime, m.MimeType)
+		}
+		if m.Size != test.size || m.Sources[0].Length() != test.size {
+			t.Errorf("test %d: expecting size %d, got %d", n+1, test.size, m.Size)
+		}
+		if !m.LastModified.Equal(modTime) {
+			t.Errorf("test %d: expecting mod time %s, got %s", n+1, modTime, m.LastModified)
+		}
+	}
+	if match("http://example.com/file") {
+		t.Error("expecting no match for http URL")
+	}
+}
@@ -0,0 +1,28 @@
+// +build !testing
+
+// Package file implements a Site for file:// URLs
+package file
+
+import (
+	"context"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+func init() {
+	downloader.DefaultRegistry.Register("file", new(localFile), downloader.PriorityDefault)
+}
+
+type localFile struct{}
+
+func (localFile) Match(text string) bool {
+	return match(text)
+}
+
+func (localFile) Request(text string) (*downloader.Request, error) {
+	return request(context.Background(), text)
+}
+
+func (localFile) RequestContext(ctx context.Context, text string) (*downloader.Request, error) {
+	return request(ctx, text)
+}
@@ -0,0 +1,58 @@
+package youtube
+
+import (
+	"mime"
+	"strings"
+)
+
+// format describes the streams of a youtube format, as identified by its
+// itag.
+type format struct {
+	width, height          int
+	videoCodec, audioCodec string
+	audioBitrate           int
+}
+
+var formats = map[string]format{
+	"5":  {400, 240, "h263", "mp3", 64000},
+	"17": {176, 144, "mp4v.20.3", "mp4a.40.2", 24000},
+	"18": {640, 360, "avc1.42001E", "mp4a.40.2", 96000},
+	"22": {1280, 720, "avc1.64001F", "mp4a.40.2", 192000},
+	"36": {320, 180, "mp4v.20.3", "mp4a.40.2", 38000},
+	"37": {1920, 1080, "avc1.640028", "mp4a.40.2", 192000},
+	"38": {4096, 3072, "avc1.640028", "mp4a.40.2", 192000},
+	"43": {640, 360, "vp8.0", "vorbis", 128000},
+	"44": {854, 480, "vp8.0", "vorbis", 128000},
+	"45": {1280, 720, "vp8.0", "vorbis", 192000},
+	"46": {1920, 1080, "vp8.0", "vorbis", 192000},
+}
+
+var audioCodecs = [...]string{"mp4a", "mp3", "vorbis", "opus", "ac-3", "ec-3"}
+
+// parseCodecs returns the video and audio codecs listed in the codecs
+// parameter of a mime type.
+func parseCodecs(m string) (video, audio string) {
+	_, params, err := mime.ParseMediaType(m)
+	if err != nil {
+		return "", ""
+	}
+	for _, codec := range strings.Split(params["codecs"], ",") {
+		codec = strings.TrimSpace(codec)
+		if codec == "" {
+			continue
+		}
+		isAudio := false
+		for _, prefix := range audioCodecs {
+			if strings.HasPrefix(codec, prefix) {
+				isAudio = true
+				break
+			}
+		}
+		if isAudio {
+			audio = codec
+		} else {
+			video = codec
+		}
+	}
+	return video, audio
+}
@@ -35,7 +35,7 @@ func parseQuality(q string) quality {
 	case "medium":
 		return qualityMedium
 	case "large":
-		return qualityMedium
+		return qualityLarge
 	case "highres":
 		return qualityHighres
 	case "hd720":
@@ -44,6 +44,25 @@ func parseQuality(q string) quality {
 	return qualityUnknown
 }
 
+// height returns the height, in pixels, of videos of the quality.
+func (q quality) height() int {
+	switch q {
+	case qualitySmall:
+		return 240
+	case qualityMedium:
+		return 360
+	case qualityLarge:
+		return 480
+	case qualityHD720:
+		return 720
+	case qualityHD1080:
+		return 1080
+	case qualityHighres:
+		return 3072
+	}
+	return 0
+}
+
 type mimeType int
 
 func (m mimeType) String() string {
@@ -60,6 +79,21 @@ func (m mimeType) String() string {
 	return "unknown mime type"
 }
 
+// container returns the name of the container format of the mime type.
+func (m mimeType) container() string {
+	switch m {
+	case mime3GPP:
+		return "3gp"
+	case mimeFLV:
+		return "flv"
+	case mimeWebM:
+		return "webm"
+	case mimeMP4:
+		return "mp4"
+	}
+	return ""
+}
+
 const (
 	mimeUnknown mimeType = iota
 	mime3GPP
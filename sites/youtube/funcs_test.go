@@ -1,6 +1,9 @@
 package youtube
 
-import "testing"
+import (
+	"sort"
+	"testing"
+)
 
 func TestGetCode(t *testing.T) {
 	tests := []struct {
@@ -35,3 +38,50 @@ func TestGetCode(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCodecs(t *testing.T) {
+	for n, test := range [...]struct {
+		mime, video, audio string
+	}{
+		{`video/mp4; codecs="avc1.42001E, mp4a.40.2"`, "avc1.42001E", "mp4a.40.2"},
+		{`video/webm; codecs="vp8.0, vorbis"`, "vp8.0", "vorbis"},
+		{`video/webm; codecs="vp9"`, "vp9", ""},
+		{`audio/webm; codecs="opus"`, "", "opus"},
+		{`video/x-flv`, "", ""},
+		{`bad mime`, "", ""},
+	} {
+		if video, audio := parseCodecs(test.mime); video != test.video || audio != test.audio {
+			t.Errorf("test %d: expecting %q and %q, got %q and %q", n+1, test.video, test.audio, video, audio)
+		}
+	}
+}
+
+func TestParseQuality(t *testing.T) {
+	for n, test := range [...]struct {
+		quality string
+		parsed  quality
+		height  int
+	}{
+		{"small", qualitySmall, 240},
+		{"medium", qualityMedium, 360},
+		{"large", qualityLarge, 480},
+		{"hd720", qualityHD720, 720},
+		{"hd1080", qualityHD1080, 1080},
+		{"highres", qualityHighres, 3072},
+		{"unknown", qualityUnknown, 0},
+	} {
+		if q := parseQuality(test.quality); q != test.parsed {
+			t.Errorf("test %d: expecting quality %d, got %d", n+1, test.parsed, q)
+		} else if h := q.height(); h != test.height {
+			t.Errorf("test %d: expecting height %d, got %d", n+1, test.height, h)
+		}
+	}
+	s := streams{
+		{quality: parseQuality("medium"), mime: mimeMP4},
+		{quality: parseQuality("large"), mime: mimeMP4},
+	}
+	sort.Sort(s)
+	if s[0].quality != qualityLarge {
+		t.Errorf("expecting large stream to sort before medium")
+	}
+}
@@ -1,6 +1,11 @@
 package youtube
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+
+	phttp "github.com/MJKWoolnough/downloader/protocols/http"
+)
 
 func quickMatch(text string) bool {
 	for _, r := range matches {
@@ -11,11 +16,24 @@ func quickMatch(text string) bool {
 	return false
 }
 
-func match(text string) bool {
+// match confirms that the text refers to a youtube video by looking up its
+// video info. A video that can't be found isn't a match, but any other
+// failure is returned as an error.
+func match(ctx context.Context, text string) (bool, error) {
 	code := getCode(text)
-	if code != "" {
-		r, _ := http.Head(videoInfoURL + code)
-		return r.StatusCode == http.StatusOK
+	if code == "" {
+		return false, nil
 	}
-	return false
+	r, err := doRequest(ctx, "HEAD", videoInfoURL+code)
+	if err != nil {
+		return false, err
+	}
+	r.Body.Close()
+	switch {
+	case r.StatusCode == http.StatusOK:
+		return true, nil
+	case r.StatusCode/100 == 4:
+		return false, nil
+	}
+	return false, phttp.UnexpectedStatus{Got: r.StatusCode, Expected: http.StatusOK}
 }
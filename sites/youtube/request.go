@@ -1,6 +1,7 @@
 package youtube
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/MJKWoolnough/downloader"
 	phttp "github.com/MJKWoolnough/downloader/protocols/http"
@@ -20,10 +22,18 @@ const (
 	fieldURL          = "url"
 	fieldFallbackHost = "fallback_host"
 	fieldMime         = "type"
+	fieldItag         = "itag"
+	fieldLength       = "length_seconds"
+	fieldAuthor       = "author"
+	fieldKeywords     = "keywords"
+	fieldDescription  = "shortDescription"
+	fieldPublishDate  = "publishDate"
 )
 
 var (
 	videoInfoURL   = "https://www.youtube.com/get_video_info?el=detailpage&video_id="
+	watchURL       = "https://www.youtube.com/watch?v="
+	thumbnailURL   = "https://i.ytimg.com/vi/"
 	requiredFields = [...]string{
 		fieldTitle,
 		fieldStreamMap,
@@ -36,11 +46,20 @@ var (
 	}
 )
 
-func getYoutubeData(u string) (url.Values, error) {
-	r, err := http.Get(u)
+func doRequest(ctx context.Context, method, u string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, nil)
 	if err != nil {
 		return nil, err
 	}
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
+
+func getYoutubeData(ctx context.Context, u string) (url.Values, error) {
+	r, err := doRequest(ctx, "GET", u)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
 	if r.StatusCode != http.StatusOK {
 		return nil, phttp.UnexpectedStatus{r.StatusCode, http.StatusOK}
 	}
@@ -62,9 +81,11 @@ func getYoutubeData(u string) (url.Values, error) {
 
 type stream struct {
 	quality
-	mime         mimeType
-	url          *url.URL
-	fallbackHost string
+	mime                   mimeType
+	url                    *url.URL
+	fallbackHost           string
+	itag                   string
+	videoCodec, audioCodec string
 }
 
 type streams []*stream
@@ -106,25 +127,59 @@ func validateStreamData(s string) *stream {
 	if err != nil {
 		return nil
 	}
-	return &stream{
+	st := &stream{
 		quality:      q,
 		mime:         mime,
 		url:          u,
 		fallbackHost: sm[fieldFallbackHost][0],
 	}
+	if len(sm[fieldItag]) > 0 {
+		st.itag = sm[fieldItag][0]
+	}
+	st.videoCodec, st.audioCodec = parseCodecs(sm[fieldMime][0])
+	if f, ok := formats[st.itag]; ok {
+		if st.videoCodec == "" {
+			st.videoCodec = f.videoCodec
+		}
+		if st.audioCodec == "" {
+			st.audioCodec = f.audioCodec
+		}
+	}
+	return st
 }
 
-func streamParser(s *stream, code string) *downloader.Media {
+// setMetadata fills in the details of the stream that are known from its
+// format, and its size and the duration of the video.
+func (s *stream) setMetadata(m *downloader.Media, duration time.Duration) {
+	m.Height = s.quality.height()
+	m.VideoCodec = s.videoCodec
+	m.AudioCodec = s.audioCodec
+	m.Container = s.mime.container()
+	m.Duration = duration
+	if f, ok := formats[s.itag]; ok {
+		m.Width, m.Height = f.width, f.height
+		m.AudioBitrate = f.audioBitrate
+	}
+	if duration > 0 && m.Size > 0 {
+		m.Bitrate = int(m.Size * 8 * int64(time.Second) / int64(duration))
+		if m.AudioBitrate > 0 && m.AudioBitrate < m.Bitrate {
+			m.VideoBitrate = m.Bitrate - m.AudioBitrate
+		}
+	}
+}
+
+func streamParser(ctx context.Context, s *stream, code string, duration time.Duration) *downloader.Media {
 	fallback := false
-	r, err := http.Head(s.url.String())
+	r, err := doRequest(ctx, "HEAD", s.url.String())
 	if err != nil {
 		fallback = true
 		s.url.Host = s.fallbackHost
-		r, err = http.Head(s.url.String())
+		r, err = doRequest(ctx, "HEAD", s.url.String())
 		if err != nil {
 			return nil
 		}
 	}
+	r.Body.Close()
 	if r.StatusCode != http.StatusOK {
 		return nil
 	}
@@ -147,21 +202,24 @@ func streamParser(s *stream, code string) *downloader.Media {
 	h := &phttp.HTTP{Client: http.DefaultClient, Request: req, Size: int64(size)}
 	sources = append(sources, h)
 	uid := "youtube-" + code + "-" + strconv.Itoa(int(s.quality)) + "-" + strconv.Itoa(int(s.mime))
-	return &downloader.Media{
+	m := &downloader.Media{
 		Size:         int64(size),
 		MimeType:     s.mime.String(),
 		UID:          uid,
 		LastModified: lastModified,
 		Sources:      sources,
+		Digest:       phttp.ParseDigest(r.Header),
 	}
+	s.setMetadata(m, duration)
+	return m
 }
 
-func request(text string) (*downloader.Request, error) {
+func request(ctx context.Context, text string) (*downloader.Request, error) {
 	code := getCode(text)
 	if code == "" {
 		return nil, UnknownCode(text)
 	}
-	v, err := getYoutubeData(videoInfoURL + code)
+	v, err := getYoutubeData(ctx, videoInfoURL+code)
 	if err != nil {
 		return nil, err
 	}
@@ -178,23 +236,100 @@ func request(text string) (*downloader.Request, error) {
 		return nil, NoStreams{}
 	}
 	sort.Sort(streamMap)
+	var duration time.Duration
+	if len(v[fieldLength]) > 0 {
+		if secs, err := strconv.Atoi(v[fieldLength][0]); err == nil {
+			duration = time.Duration(secs) * time.Second
+		}
+	}
 	media := make([]downloader.Media, 0, len(streamMap))
 	for _, stream := range streamMap {
-		m := streamParser(stream, code)
+		m := streamParser(ctx, stream, code, duration)
 		if m == nil {
 			continue
 		}
 		media = append(media, *m)
 	}
 	if len(media) == 0 {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, NoStreams{}
 	}
 	return &downloader.Request{
-		Filename:    v[fieldTitle][0] + ".mp4",
+		Filename:    v[fieldTitle][0] + media[0].Extension(),
 		Downloaders: media,
+		Metadata:    metadata(v, code),
 	}, nil
 }
 
+// thumbnailSizes are the standard thumbnails that youtube has for every
+// video.
+var thumbnailSizes = [...]struct {
+	name          string
+	width, height int
+}{
+	{"default", 120, 90},
+	{"mqdefault", 320, 180},
+	{"hqdefault", 480, 360},
+}
+
+// metadata builds the Metadata for a video from its info.
+func metadata(v url.Values, code string) downloader.Metadata {
+	md := downloader.Metadata{
+		Title: v.Get(fieldTitle),
+		URL:   watchURL + code,
+	}
+	md.Author = v.Get(fieldAuthor)
+	md.Description = v.Get(fieldDescription)
+	if d, err := time.Parse("2006-01-02", v.Get(fieldPublishDate)); err == nil {
+		md.UploadDate = d
+	}
+	for _, tag := range strings.Split(v.Get(fieldKeywords), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			md.Tags = append(md.Tags, tag)
+		}
+	}
+	// The thumbnails of a video don't change, so they are given the upload
+	// date, which is fixed, as their modification time, allowing them to be
+	// reused from a cache.
+	for _, t := range thumbnailSizes {
+		u := thumbnailURL + code + "/" + t.name + ".jpg"
+		req, _ := http.NewRequest("GET", u, nil)
+		md.Thumbnails = append(md.Thumbnails, downloader.Media{
+			Size:         downloader.UnknownLength,
+			MimeType:     "image/jpeg",
+			UID:          "youtube-" + code + "-" + t.name,
+			LastModified: md.UploadDate,
+			Sources: []downloader.Downloader{
+				&phttp.HTTP{Client: http.DefaultClient, Request: req, Size: downloader.UnknownLength},
+			},
+			Width:  t.width,
+			Height: t.height,
+		})
+	}
+	return md
+}
+
+// refresh requests the video again, returning the Media with the given UID,
+// whose URLs will replace those that have expired.
+func refresh(ctx context.Context, uid string) (downloader.Media, error) {
+	code := strings.TrimPrefix(uid, "youtube-")
+	if code == uid || len(code) < 11 {
+		return downloader.Media{}, UnknownCode(uid)
+	}
+	r, err := request(ctx, "https://youtu.be/"+code[:11])
+	if err != nil {
+		return downloader.Media{}, err
+	}
+	for _, m := range r.Downloaders {
+		if m.UID == uid {
+			return m, nil
+		}
+	}
+	return downloader.Media{}, NoStreams{}
+}
+
 // Errors
 
 // UnknownCode is an error returned when no youtube identifier is found.
@@ -204,6 +339,11 @@ func (u UnknownCode) Error() string {
 	return "could not find youtube identifier: " + string(u)
 }
 
+// NotMine returns true, so that other Sites can try the URL.
+func (UnknownCode) NotMine() bool {
+	return true
+}
+
 // MissingField is an error that is returned when a required field is missing
 // from the data gathered from the youtube servers.
 type MissingField string
@@ -1,12 +1,16 @@
 package youtube
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
 )
 
 func urlValues(data ...string) url.Values {
@@ -48,7 +52,7 @@ func TestGetYoutubeData(t *testing.T) {
 
 	for n, test := range tests {
 		s = stringHTTP(test.data)
-		v, err := getYoutubeData(srv.URL)
+		v, err := getYoutubeData(context.Background(), srv.URL)
 		if !reflect.DeepEqual(err, test.err) {
 			t.Errorf("test %d: expecting error %s, got %s", n+1, test.err, err)
 		} else if !reflect.DeepEqual(v, test.Values) {
@@ -77,3 +81,81 @@ func TestValidataStreamData(t *testing.T) {
 		}
 	}
 }
+
+func TestSetMetadata(t *testing.T) {
+	for n, test := range [...]struct {
+		data     string
+		size     int64
+		duration time.Duration
+		expected downloader.Media
+	}{
+		{
+			urlValues(fieldQuality+"=hd720", fieldMime+`=video/mp4; codecs="avc1.64001F, mp4a.40.2"`, fieldURL+"=http://www.youtube.com/", fieldFallbackHost+"=google.com", fieldItag+"=22").Encode(),
+			1000000,
+			10 * time.Second,
+			downloader.Media{Size: 1000000, Width: 1280, Height: 720, Bitrate: 800000, VideoBitrate: 608000, AudioBitrate: 192000, VideoCodec: "avc1.64001F", AudioCodec: "mp4a.40.2", Duration: 10 * time.Second, Container: "mp4"},
+		},
+		{
+			urlValues(fieldQuality+"=large", fieldMime+"=video/webm", fieldURL+"=http://www.youtube.com/", fieldFallbackHost+"=google.com", fieldItag+"=44").Encode(),
+			500,
+			0,
+			downloader.Media{Size: 500, Width: 854, Height: 480, AudioBitrate: 128000, VideoCodec: "vp8.0", AudioCodec: "vorbis", Container: "webm"},
+		},
+		{
+			urlValues(fieldQuality+"=medium", fieldMime+"=video/x-flv", fieldURL+"=http://www.youtube.com/", fieldFallbackHost+"=google.com").Encode(),
+			500,
+			time.Second,
+			downloader.Media{Size: 500, Height: 360, Bitrate: 4000, Duration: time.Second, Container: "flv"},
+		},
+	} {
+		s := validateStreamData(test.data)
+		if s == nil {
+			t.Errorf("test %d: invalid stream data", n+1)
+			continue
+		}
+		m := downloader.Media{Size: test.size}
+		s.setMetadata(&m, test.duration)
+		if !reflect.DeepEqual(m, test.expected) {
+			t.Errorf("test %d: expecting %+v, got %+v", n+1, test.expected, m)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	v := urlValues(fieldTitle+"=A Video", fieldAuthor+"=Someone", fieldKeywords+"=one, two,,three", fieldDescription+"=About the video", fieldPublishDate+"=2017-03-04")
+	md := metadata(v, "abcde-fg_12")
+	if md.Title != "A Video" || md.Author != "Someone" {
+		t.Errorf("unexpected title and author: %q, %q", md.Title, md.Author)
+	}
+	if md.Description != "About the video" {
+		t.Errorf("unexpected description: %q", md.Description)
+	}
+	if uploaded := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC); !md.UploadDate.Equal(uploaded) {
+		t.Errorf("expecting upload date %s, got %s", uploaded, md.UploadDate)
+	}
+	if md.URL != "https://www.youtube.com/watch?v=abcde-fg_12" {
+		t.Errorf("unexpected URL: %q", md.URL)
+	}
+	if !reflect.DeepEqual(md.Tags, []string{"one", "two", "three"}) {
+		t.Errorf("unexpected tags: %q", md.Tags)
+	}
+	if len(md.Thumbnails) != len(thumbnailSizes) {
+		t.Fatalf("expecting %d thumbnails, got %d", len(thumbnailSizes), len(md.Thumbnails))
+	}
+	for n, th := range md.Thumbnails {
+		if th.Extension() != ".jpg" || th.Width != thumbnailSizes[n].width || th.Sources[0].Length() != downloader.UnknownLength {
+			t.Errorf("thumbnail %d: unexpected media %+v", n+1, th)
+		}
+	}
+	again := metadata(v, "abcde-fg_12")
+	for n, th := range md.Thumbnails {
+		if th.UID != again.Thumbnails[n].UID || !th.LastModified.Equal(again.Thumbnails[n].LastModified) {
+			t.Errorf("thumbnail %d: expecting the same UID and mod time on each request", n+1)
+		} else if !th.LastModified.Equal(md.UploadDate) {
+			t.Errorf("thumbnail %d: expecting mod time %s, got %s", n+1, md.UploadDate, th.LastModified)
+		}
+	}
+	if md = metadata(urlValues(fieldTitle+"=A Video", fieldPublishDate+"=unknown"), "abcde-fg_12"); !md.UploadDate.IsZero() {
+		t.Errorf("expecting zero upload date for a bad date, got %s", md.UploadDate)
+	}
+}
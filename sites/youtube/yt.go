@@ -3,10 +3,14 @@
 // Package youtube implements a Youtube downloader
 package youtube
 
-import "github.com/MJKWoolnough/downloader"
+import (
+	"context"
+
+	"github.com/MJKWoolnough/downloader"
+)
 
 func init() {
-	downloader.Register(new(youtube))
+	downloader.DefaultRegistry.Register("youtube", new(youtube), downloader.PriorityDefault)
 }
 
 type youtube struct{}
@@ -15,6 +19,18 @@ func (youtube) Match(text string) bool {
 	return quickMatch(text)
 }
 
+func (youtube) Confirm(ctx context.Context, text string) (bool, error) {
+	return match(ctx, text)
+}
+
 func (youtube) Request(text string) (*downloader.Request, error) {
-	return request(text)
+	return request(context.Background(), text)
+}
+
+func (youtube) RequestContext(ctx context.Context, text string) (*downloader.Request, error) {
+	return request(ctx, text)
+}
+
+func (youtube) Refresh(ctx context.Context, uid string) (downloader.Media, error) {
+	return refresh(ctx, uid)
 }
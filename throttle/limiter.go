@@ -0,0 +1,79 @@
+// Package throttle implements bandwidth limiting for downloaders
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket that limits the rate, in bytes per second, at
+// which data can be read. The rate can be changed at any time and takes
+// effect immediately for all readers using the Limiter.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a Limiter with the given rate. A rate of zero or less
+// means unlimited.
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{
+		rate: rate,
+		last: time.Now(),
+	}
+	l.tokens = l.burst()
+	return l
+}
+
+// burst is the maximum number of tokens the bucket can hold, which allows for
+// one second of data to be read at once.
+func (l *Limiter) burst() float64 {
+	return float64(l.rate)
+}
+
+// Rate returns the current rate of the Limiter.
+func (l *Limiter) Rate() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+// SetRate changes the rate of the Limiter. A rate of zero or less means
+// unlimited.
+func (l *Limiter) SetRate(rate int64) {
+	l.mutex.Lock()
+	l.fill(time.Now())
+	l.rate = rate
+	if b := l.burst(); l.tokens > b {
+		l.tokens = b
+	}
+	l.mutex.Unlock()
+}
+
+func (l *Limiter) fill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if b := l.burst(); l.tokens > b {
+			l.tokens = b
+		}
+	}
+	l.last = now
+}
+
+// take removes n tokens from the bucket, returning how long the caller needs
+// to wait until the bucket is no longer in debt.
+func (l *Limiter) take(n int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.fill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
@@ -0,0 +1,198 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/MJKWoolnough/downloader"
+)
+
+// maxRead is the largest single read made from a throttled ReadCloser, which
+// keeps the flow of data smooth.
+const maxRead = 32 * 1024
+
+// Hoster is implemented by Downloaders that know which host they download
+// from, allowing per-host limits to be applied.
+type Hoster interface {
+	Host() string
+}
+
+// Throttle holds a global Limiter along with Limiters for each Site and
+// upstream host. All of the limits can be changed while downloads are in
+// progress.
+type Throttle struct {
+	global *Limiter
+	mutex  sync.Mutex
+	sites  map[string]*Limiter
+	hosts  map[string]*Limiter
+}
+
+// New creates a Throttle with no limits set.
+func New() *Throttle {
+	return &Throttle{
+		global: NewLimiter(0),
+		sites:  make(map[string]*Limiter),
+		hosts:  make(map[string]*Limiter),
+	}
+}
+
+// SetGlobal sets the rate limit, in bytes per second, shared by all
+// downloads. A rate of zero or less means unlimited.
+func (t *Throttle) SetGlobal(rate int64) {
+	t.global.SetRate(rate)
+}
+
+// SetSite sets the rate limit shared by all downloads for the named Site.
+func (t *Throttle) SetSite(site string, rate int64) {
+	t.limiter(t.sites, site).SetRate(rate)
+}
+
+// SetHost sets the rate limit shared by all downloads from the given host.
+func (t *Throttle) SetHost(host string, rate int64) {
+	t.limiter(t.hosts, host).SetRate(rate)
+}
+
+func (t *Throttle) limiter(m map[string]*Limiter, key string) *Limiter {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	l, ok := m[key]
+	if !ok {
+		l = NewLimiter(0)
+		m[key] = l
+	}
+	return l
+}
+
+// Wrap returns a Downloader whose ReadClosers are limited by the global
+// limit, the limit for the named Site and, if the Downloader implements
+// Hoster, the limit for its host.
+func (t *Throttle) Wrap(site string, d downloader.Downloader) downloader.Downloader {
+	limiters := []*Limiter{t.global, t.limiter(t.sites, site)}
+	if h, ok := d.(Hoster); ok {
+		limiters = append(limiters, t.limiter(t.hosts, h.Host()))
+	}
+	return Wrap(d, limiters...)
+}
+
+// WrapMedia returns a copy of the Media with each of its Sources wrapped.
+func (t *Throttle) WrapMedia(site string, m downloader.Media) downloader.Media {
+	sources := make([]downloader.Downloader, len(m.Sources))
+	for n, s := range m.Sources {
+		sources[n] = t.Wrap(site, s)
+	}
+	m.Sources = sources
+	if _, ok := m.Origin.(downloader.Refresher); ok {
+		m.Origin = origin{Site: m.Origin, throttle: t, site: site}
+	}
+	return m
+}
+
+// origin wraps the Site of a Media so that the Sources of refreshed Media are
+// throttled like the originals.
+type origin struct {
+	downloader.Site
+	throttle *Throttle
+	site     string
+}
+
+// Refresh refreshes the Media using the wrapped Site, wrapping its Sources.
+func (o origin) Refresh(ctx context.Context, uid string) (downloader.Media, error) {
+	m, err := o.Site.(downloader.Refresher).Refresh(ctx, uid)
+	if err != nil {
+		return m, err
+	}
+	return o.throttle.WrapMedia(o.site, m), nil
+}
+
+// Downloader is a downloader.Downloader whose ReadClosers are limited by a
+// set of Limiters.
+type Downloader struct {
+	downloader.Downloader
+	limiters []*Limiter
+}
+
+// Wrap returns a Downloader whose ReadClosers are limited by each of the
+// given Limiters.
+func Wrap(d downloader.Downloader, limiters ...*Limiter) *Downloader {
+	return &Downloader{
+		Downloader: d,
+		limiters:   limiters,
+	}
+}
+
+// Host returns the host of the underlying Downloader, if it implements
+// Hoster.
+func (d *Downloader) Host() string {
+	if h, ok := d.Downloader.(Hoster); ok {
+		return h.Host()
+	}
+	return ""
+}
+
+// Sequential returns whether the underlying Downloader can only be read from
+// the start, if it implements downloader.SequentialDownloader.
+func (d *Downloader) Sequential() bool {
+	if s, ok := d.Downloader.(downloader.SequentialDownloader); ok {
+		return s.Sequential()
+	}
+	return false
+}
+
+// NewReadCloser returns a throttled ReadCloser from the underlying
+// Downloader.
+func (d *Downloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	return d.NewReadCloserContext(context.Background(), start, length)
+}
+
+// NewReadCloserContext returns a throttled ReadCloser from the underlying
+// Downloader, which stops waiting when the context is cancelled.
+func (d *Downloader) NewReadCloserContext(ctx context.Context, start, length int64) (io.ReadCloser, error) {
+	rc, err := downloader.NewReadCloserContext(ctx, d.Downloader, start, length)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{
+		ReadCloser: rc,
+		ctx:        ctx,
+		limiters:   d.limiters,
+	}, nil
+}
+
+type readCloser struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*Limiter
+}
+
+// Verifying reports whether the underlying ReadCloser checks its data
+// against a digest.
+func (r *readCloser) Verifying() bool {
+	return downloader.IsVerifying(r.ReadCloser)
+}
+
+func (r *readCloser) Read(p []byte) (int, error) {
+	if len(p) > maxRead {
+		p = p[:maxRead]
+	}
+	n, err := r.ReadCloser.Read(p)
+	var wait time.Duration
+	for _, l := range r.limiters {
+		if w := l.take(n); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			t.Stop()
+			if err == nil {
+				err = r.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,76 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stringDownloader string
+
+func (s stringDownloader) NewReadCloser(start, length int64) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(string(s[start : start+length]))), nil
+}
+
+func (s stringDownloader) Length() int64 {
+	return int64(len(s))
+}
+
+func (s stringDownloader) Host() string {
+	return "example.com"
+}
+
+func TestLimiterTake(t *testing.T) {
+	l := NewLimiter(1000)
+	if w := l.take(1000); w != 0 {
+		t.Errorf("expecting no wait for burst, got %s", w)
+	}
+	if w := l.take(500); w < 490*time.Millisecond || w > 500*time.Millisecond {
+		t.Errorf("expecting wait of around 500ms, got %s", w)
+	}
+	l.SetRate(0)
+	if w := l.take(1 << 30); w != 0 {
+		t.Errorf("expecting no wait when unlimited, got %s", w)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	const rate = 64 * 1024
+	data := strings.Repeat("a", rate+rate/2)
+	th := New()
+	th.SetHost("example.com", rate)
+	d := th.Wrap("", stringDownloader(data))
+
+	start := time.Now()
+	rc, err := d.NewReadCloser(0, int64(len(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(got) != data {
+		t.Fatalf("throttled data does not match source")
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expecting read to take at least 400ms, took %s", elapsed)
+	}
+
+	th.SetHost("example.com", 0)
+	start = time.Now()
+	rc, _ = d.NewReadCloser(0, int64(len(data)))
+	ioutil.ReadAll(rc)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expecting removed limit to take effect, took %s", elapsed)
+	}
+
+	th.SetGlobal(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rc, _ = th.Wrap("", stringDownloader(data)).(*Downloader).NewReadCloserContext(ctx, 0, int64(len(data)))
+	if _, err = ioutil.ReadAll(rc); err != context.DeadlineExceeded {
+		t.Errorf("expecting error %s, got %v", context.DeadlineExceeded, err)
+	}
+}